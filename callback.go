@@ -28,12 +28,14 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"runtime/debug"
 	"sync"
 	"unsafe"
 )
 
 //export callbackTrampoline
 func callbackTrampoline(ctx *C.sqlite3_context, argc int, argv **C.sqlite3_value) {
+	defer callbackRecover(ctx)
 	args := (*[(math.MaxInt32 - 1) / unsafe.Sizeof((*C.sqlite3_value)(nil))]*C.sqlite3_value)(unsafe.Pointer(argv))[:argc:argc]
 	fi := lookupHandle(C.sqlite3_user_data(ctx)).(*functionInfo)
 	fi.Call(ctx, args)
@@ -41,6 +43,7 @@ func callbackTrampoline(ctx *C.sqlite3_context, argc int, argv **C.sqlite3_value
 
 //export stepTrampoline
 func stepTrampoline(ctx *C.sqlite3_context, argc C.int, argv **C.sqlite3_value) {
+	defer callbackRecover(ctx)
 	args := (*[(math.MaxInt32 - 1) / unsafe.Sizeof((*C.sqlite3_value)(nil))]*C.sqlite3_value)(unsafe.Pointer(argv))[:int(argc):int(argc)]
 	ai := lookupHandle(C.sqlite3_user_data(ctx)).(*aggInfo)
 	ai.Step(ctx, args)
@@ -48,42 +51,60 @@ func stepTrampoline(ctx *C.sqlite3_context, argc C.int, argv **C.sqlite3_value)
 
 //export doneTrampoline
 func doneTrampoline(ctx *C.sqlite3_context) {
+	defer callbackRecover(ctx)
 	ai := lookupHandle(C.sqlite3_user_data(ctx)).(*aggInfo)
 	ai.Done(ctx)
 }
 
 //export compareTrampoline
 func compareTrampoline(handlePtr unsafe.Pointer, la C.int, a *C.char, lb C.int, b *C.char) C.int {
+	defer hookRecover(handlePtr)
 	cmp := lookupHandle(handlePtr).(func(string, string) int)
 	return C.int(cmp(C.GoStringN(a, la), C.GoStringN(b, lb)))
 }
 
 //export commitHookTrampoline
-func commitHookTrampoline(handle unsafe.Pointer) int {
+func commitHookTrampoline(handle unsafe.Pointer) (rollback int) {
+	defer func() {
+		if r := recover(); r != nil {
+			newPanicError(lookupHandleVal(handle).db, r)
+			// turn the commit into a rollback
+			rollback = 1
+		}
+	}()
 	callback := lookupHandle(handle).(func() int)
 	return callback()
 }
 
 //export rollbackHookTrampoline
 func rollbackHookTrampoline(handle unsafe.Pointer) {
+	defer hookRecover(handle)
 	callback := lookupHandle(handle).(func())
 	callback()
 }
 
 //export updateHookTrampoline
 func updateHookTrampoline(handle unsafe.Pointer, op int, db *C.char, table *C.char, rowid int64) {
+	defer hookRecover(handle)
 	callback := lookupHandle(handle).(func(int, string, string, int64))
 	callback(op, C.GoString(db), C.GoString(table), rowid)
 }
 
 //export authorizerTrampoline
-func authorizerTrampoline(handle unsafe.Pointer, op int, arg1 *C.char, arg2 *C.char, arg3 *C.char) int {
+func authorizerTrampoline(handle unsafe.Pointer, op int, arg1 *C.char, arg2 *C.char, arg3 *C.char) (rv int) {
+	defer func() {
+		if r := recover(); r != nil {
+			newPanicError(lookupHandleVal(handle).db, r)
+			rv = C.SQLITE_DENY
+		}
+	}()
 	callback := lookupHandle(handle).(func(int, string, string, string) int)
 	return callback(op, C.GoString(arg1), C.GoString(arg2), C.GoString(arg3))
 }
 
 //export preUpdateHookTrampoline
 func preUpdateHookTrampoline(handle unsafe.Pointer, dbHandle uintptr, op int, db *C.char, table *C.char, oldrowid int64, newrowid int64) {
+	defer hookRecover(handle)
 	hval := lookupHandleVal(handle)
 	data := SQLitePreUpdateData{
 		Conn:         hval.db,
@@ -97,6 +118,51 @@ func preUpdateHookTrampoline(handle unsafe.Pointer, dbHandle uintptr, op int, db
 	callback(data)
 }
 
+// PanicError is the error reported to SQLite when a Go callback it invoked
+// (a function, a hook, a virtual table method...) panics.
+type PanicError struct {
+	Value any    // value passed to panic
+	Stack []byte // stack trace of the panicking goroutine
+
+	withStack bool
+}
+
+func (e *PanicError) Error() string {
+	if e.withStack {
+		return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+	}
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// newPanicError returns the error of the panic r, recovered from a
+// callback of the connection c, and notifies the PanicHook of c.
+func newPanicError(c *SQLiteConn, r any) *PanicError {
+	e := &PanicError{Value: r, Stack: debug.Stack()}
+	if c != nil {
+		e.withStack = c.panicStackTrace
+		if c.panicHook != nil {
+			c.panicHook(e)
+		}
+	}
+	return e
+}
+
+// callbackRecover reports a panic of a function callback as the error
+// of ctx. It must be deferred.
+func callbackRecover(ctx *C.sqlite3_context) {
+	if r := recover(); r != nil {
+		callbackError(ctx, newPanicError(lookupHandleVal(C.sqlite3_user_data(ctx)).db, r))
+	}
+}
+
+// hookRecover swallows a panic of the callback of handle, which has no
+// way to report errors to SQLite. It must be deferred.
+func hookRecover(handle unsafe.Pointer) {
+	if r := recover(); r != nil {
+		newPanicError(lookupHandleVal(handle).db, r)
+	}
+}
+
 // Use handles to avoid passing Go pointers to C.
 type handleVal struct {
 	db  *SQLiteConn
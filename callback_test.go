@@ -9,9 +9,11 @@
 package sqlite3
 
 import (
+	"database/sql"
 	"errors"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -115,3 +117,43 @@ func TestCallbackReturnAny(t *testing.T) {
 		t.Errorf("Expected valid callback for any return type, got: %s", err)
 	}
 }
+
+func TestCallbackPanic(t *testing.T) {
+	var recovered []*PanicError
+	sql.Register("sqlite3_TestCallbackPanic", &SQLiteDriver{
+		PanicHook: func(e *PanicError) {
+			recovered = append(recovered, e)
+		},
+		PanicStackTrace: true,
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.RegisterFunc("boom", func(s string) string {
+				panic(s)
+			}, true)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestCallbackPanic", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var s string
+	err = db.QueryRow("SELECT boom('kaboom')").Scan(&s)
+	if err == nil {
+		t.Fatal("expected an error from a panicking function")
+	}
+	if !strings.Contains(err.Error(), "panic: kaboom") {
+		t.Fatalf("expected the panic message in the error, got %q", err)
+	}
+	if !strings.Contains(err.Error(), "goroutine") {
+		t.Fatalf("expected the stack trace in the error, got %q", err)
+	}
+	if len(recovered) != 1 || recovered[0].Value != "kaboom" || len(recovered[0].Stack) == 0 {
+		t.Fatalf("expected the panic hook to be called once, got %v", recovered)
+	}
+
+	// the connection is still usable
+	if err := db.QueryRow("SELECT 'ok'").Scan(&s); err != nil || s != "ok" {
+		t.Fatalf("expected the connection to survive the panic, got %q %v", s, err)
+	}
+}
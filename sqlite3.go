@@ -357,6 +357,13 @@ const (
 type SQLiteDriver struct {
 	Extensions  []string
 	ConnectHook func(*SQLiteConn) error
+	// PanicHook is called with the panics recovered from the Go callbacks
+	// invoked by SQLite: functions, hooks and virtual table methods.
+	// A recovered panic fails the SQL statement that triggered it.
+	PanicHook func(*PanicError)
+	// PanicStackTrace adds the stack trace of recovered panics to the
+	// error message reported to SQLite.
+	PanicStackTrace bool
 }
 
 // SQLiteConn implements driver.Conn.
@@ -367,6 +374,17 @@ type SQLiteConn struct {
 	txlock      string
 	funcs       []*functionInfo
 	aggregators []*aggInfo
+
+	panicHook       func(*PanicError)
+	panicStackTrace bool
+
+	// stepStmt is the context of the statement being stepped, exposed to
+	// virtual tables. It is only used by the goroutine stepping it.
+	stepStmt *stmtContext
+
+	// vtabs is the state of the virtual tables of the connection, empty
+	// without the sqlite_vtable build tag.
+	vtabs vtabConn
 }
 
 // SQLiteTx implements driver.Tx.
@@ -382,6 +400,9 @@ type SQLiteStmt struct {
 	t      string
 	closed bool
 	cls    bool // True if the statement was created by SQLiteConn.Query
+	// stmtCtx is the context of the statement while it is executed by
+	// exec, see SQLiteRows for queries
+	stmtCtx stmtContext
 }
 
 // SQLiteResult implements sql.Result.
@@ -399,6 +420,7 @@ type SQLiteRows struct {
 	decltype []string
 	ctx      context.Context // no better alternative to pass context into Next() method
 	closemu  sync.Mutex
+	stmtCtx  stmtContext
 }
 
 type functionInfo struct {
@@ -620,17 +642,42 @@ func (c *SQLiteConn) RegisterAuthorizer(callback func(int, string, string, strin
 //
 // See _example/go_custom_funcs for a detailed example.
 func (c *SQLiteConn) RegisterFunc(name string, impl any, pure bool) error {
+	fi, numArgs, err := newFunctionInfo(impl)
+	if err != nil {
+		return err
+	}
+
+	// fi must outlast the database connection, or we'll have dangling pointers.
+	c.funcs = append(c.funcs, fi)
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	opts := C.SQLITE_UTF8
+	if pure {
+		opts |= C.SQLITE_DETERMINISTIC
+	}
+	rv := sqlite3CreateFunction(c.db, cname, C.int(numArgs), C.int(opts), newHandle(c, fi), C.callbackTrampoline, nil, nil)
+	if rv != C.SQLITE_OK {
+		return c.lastError()
+	}
+	return nil
+}
+
+// newFunctionInfo returns the functionInfo of the Go function impl, as
+// documented by RegisterFunc, along with its number of SQL arguments,
+// -1 for variadic functions.
+func newFunctionInfo(impl any) (*functionInfo, int, error) {
 	var fi functionInfo
 	fi.f = reflect.ValueOf(impl)
 	t := fi.f.Type()
 	if t.Kind() != reflect.Func {
-		return errors.New("Non-function passed to RegisterFunc")
+		return nil, 0, errors.New("Non-function passed to RegisterFunc")
 	}
 	if t.NumOut() != 1 && t.NumOut() != 2 {
-		return errors.New("SQLite functions must return 1 or 2 values")
+		return nil, 0, errors.New("SQLite functions must return 1 or 2 values")
 	}
 	if t.NumOut() == 2 && !t.Out(1).Implements(reflect.TypeOf((*error)(nil)).Elem()) {
-		return errors.New("Second return value of SQLite function must be error")
+		return nil, 0, errors.New("Second return value of SQLite function must be error")
 	}
 
 	numArgs := t.NumIn()
@@ -641,7 +688,7 @@ func (c *SQLiteConn) RegisterFunc(name string, impl any, pure bool) error {
 	for i := 0; i < numArgs; i++ {
 		conv, err := callbackArg(t.In(i))
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
 		fi.argConverters = append(fi.argConverters, conv)
 	}
@@ -649,7 +696,7 @@ func (c *SQLiteConn) RegisterFunc(name string, impl any, pure bool) error {
 	if t.IsVariadic() {
 		conv, err := callbackArg(t.In(numArgs).Elem())
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
 		fi.variadicConverter = conv
 		// Pass -1 to sqlite so that it allows any number of
@@ -660,24 +707,10 @@ func (c *SQLiteConn) RegisterFunc(name string, impl any, pure bool) error {
 
 	conv, err := callbackRet(t.Out(0))
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	fi.retConverter = conv
-
-	// fi must outlast the database connection, or we'll have dangling pointers.
-	c.funcs = append(c.funcs, &fi)
-
-	cname := C.CString(name)
-	defer C.free(unsafe.Pointer(cname))
-	opts := C.SQLITE_UTF8
-	if pure {
-		opts |= C.SQLITE_DETERMINISTIC
-	}
-	rv := sqlite3CreateFunction(c.db, cname, C.int(numArgs), C.int(opts), newHandle(c, &fi), C.callbackTrampoline, nil, nil)
-	if rv != C.SQLITE_OK {
-		return c.lastError()
-	}
-	return nil
+	return &fi, numArgs, nil
 }
 
 func sqlite3CreateFunction(db *C.sqlite3, zFunctionName *C.char, nArg C.int, eTextRep C.int, pApp unsafe.Pointer, xFunc unsafe.Pointer, xStep unsafe.Pointer, xFinal unsafe.Pointer) C.int {
@@ -1516,7 +1549,7 @@ func (d *SQLiteDriver) Open(dsn string) (driver.Conn, error) {
 	//
 
 	// Create connection to SQLite
-	conn := &SQLiteConn{db: db, loc: loc, txlock: txlock}
+	conn := &SQLiteConn{db: db, loc: loc, txlock: txlock, panicHook: d.PanicHook, panicStackTrace: d.PanicStackTrace}
 
 	// Password Cipher has to be registered before authentication
 	if len(authCrypt) > 0 {
@@ -1822,7 +1855,7 @@ func (c *SQLiteConn) prepare(ctx context.Context, query string) (driver.Stmt, er
 	if tail != nil && *tail != '\000' {
 		t = strings.TrimSpace(C.GoString(tail))
 	}
-	ss := &SQLiteStmt{c: c, s: s, t: t}
+	ss := &SQLiteStmt{c: c, s: s, t: t, stmtCtx: stmtContext{vtabGen: c.vtabs.gen}}
 	runtime.SetFinalizer(ss, (*SQLiteStmt).Close)
 	return ss, nil
 }
@@ -2013,6 +2046,7 @@ func (s *SQLiteStmt) query(ctx context.Context, args []driver.NamedValue) (drive
 		cols:     nil,
 		decltype: nil,
 		ctx:      ctx,
+		stmtCtx:  stmtContext{parent: ctx, vtabGen: s.stmtCtx.vtabGen},
 	}
 
 	return rows, nil
@@ -2040,6 +2074,83 @@ func (s *SQLiteStmt) Exec(args []driver.Value) (driver.Result, error) {
 	return s.exec(context.Background(), list)
 }
 
+// stmtContext is the context of a statement exposed to virtual tables. It
+// is only created when a virtual table asks for it, so that statements
+// not using virtual tables do not pay for it, and lives until the
+// statement is done: it is cancelled when its rows are closed or its
+// execution completes, and with its parent, the context of the query,
+// which also interrupts the statement.
+type stmtContext struct {
+	parent context.Context
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   bool
+
+	// vtabGen is the generation of the virtual table schemas when the
+	// statement was prepared, and schemaChanged tells that it used a
+	// virtual table invalidated since, see InvalidateVTabSchemas. They are
+	// only used by the goroutine stepping the statement.
+	vtabGen       uint64
+	schemaChanged bool
+}
+
+// begin resets sc for a new execution of a statement, run with parent.
+func (sc *stmtContext) begin(parent context.Context) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.parent, sc.ctx, sc.cancel, sc.done = parent, nil, nil, false
+	sc.schemaChanged = false
+}
+
+// lastError returns the error of the statement of sc, whose step failed.
+func (sc *stmtContext) lastError(c *SQLiteConn) error {
+	if sc.schemaChanged {
+		return Error{Code: ErrSchema, err: "virtual table schema changed since the statement was prepared"}
+	}
+	return c.lastError()
+}
+
+// context returns the context of the statement, creating it if needed.
+func (sc *stmtContext) context() context.Context {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.ctx == nil {
+		sc.ctx, sc.cancel = context.WithCancel(sc.parent)
+		if sc.done {
+			sc.cancel()
+		}
+	}
+	return sc.ctx
+}
+
+// end cancels the context of the statement, which is done.
+func (sc *stmtContext) end() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.done = true
+	if sc.cancel != nil {
+		sc.cancel()
+	}
+}
+
+// swapStepStmt records sc as the context of the statement being stepped,
+// and returns the previous one, to be restored once the step is done.
+func (c *SQLiteConn) swapStepStmt(sc *stmtContext) *stmtContext {
+	prev := c.stepStmt
+	c.stepStmt = sc
+	return prev
+}
+
+// stepContext returns the context of the statement being stepped, or
+// context.Background() outside of a statement.
+func (c *SQLiteConn) stepContext() context.Context {
+	if c.stepStmt == nil {
+		return context.Background()
+	}
+	return c.stepStmt.context()
+}
+
 func isInterruptErr(err error) bool {
 	sqliteErr, ok := err.(Error)
 	if ok {
@@ -2050,6 +2161,10 @@ func isInterruptErr(err error) bool {
 
 // exec executes a query that doesn't return rows. Attempts to honor context timeout.
 func (s *SQLiteStmt) exec(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	s.stmtCtx.begin(ctx)
+	defer s.stmtCtx.end()
+	// s is the statement being stepped until exec returns
+	defer s.c.swapStepStmt(s.c.swapStepStmt(&s.stmtCtx))
 	if ctx.Done() == nil {
 		return s.execSync(args)
 	}
@@ -2092,7 +2207,7 @@ func (s *SQLiteStmt) execSync(args []driver.NamedValue) (driver.Result, error) {
 	var rowid, changes C.longlong
 	rv := C._sqlite3_step_row_internal(s.s, &rowid, &changes)
 	if rv != C.SQLITE_ROW && rv != C.SQLITE_OK && rv != C.SQLITE_DONE {
-		err := s.c.lastError()
+		err := s.stmtCtx.lastError(s.c)
 		C.sqlite3_reset(s.s)
 		C.sqlite3_clear_bindings(s.s)
 		return nil, err
@@ -2112,6 +2227,7 @@ func (s *SQLiteStmt) Readonly() bool {
 func (rc *SQLiteRows) Close() error {
 	rc.closemu.Lock()
 	defer rc.closemu.Unlock()
+	defer rc.stmtCtx.end()
 	s := rc.s
 	if s == nil {
 		return nil
@@ -2174,6 +2290,8 @@ func (rc *SQLiteRows) Next(dest []driver.Value) error {
 		return io.EOF
 	}
 
+	// rc is the statement being stepped until Next returns
+	defer rc.s.c.swapStepStmt(rc.s.c.swapStepStmt(&rc.stmtCtx))
 	if rc.ctx.Done() == nil {
 		return rc.nextSyncLocked(dest)
 	}
@@ -2206,7 +2324,7 @@ func (rc *SQLiteRows) nextSyncLocked(dest []driver.Value) error {
 	if rv != C.SQLITE_ROW {
 		rv = C.sqlite3_reset(rc.s.s)
 		if rv != C.SQLITE_OK {
-			return rc.s.c.lastError()
+			return rc.stmtCtx.lastError(rc.s.c)
 		}
 		return nil
 	}
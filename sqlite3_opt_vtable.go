@@ -95,17 +95,38 @@ static inline int cXDestroy(sqlite3_vtab *pVTab) {
 	return cXRelease(pVTab, 1);
 }
 
+typedef struct goVCell goVCell;
+
+// goVCell is a value of a row produced by a VTabCursorBatch.
+struct goVCell {
+	int type;
+	sqlite3_int64 i;
+	double d;
+	const char *p;
+	int n;
+};
+
 typedef struct goVTabCursor goVTabCursor;
 
 struct goVTabCursor {
 	sqlite3_vtab_cursor base;
 	void *vTabCursor;
+	// Batch cursors are iterated from C, a batch of nRow rows of nCol
+	// cells at a time. The cells and the text they point to are a single
+	// allocation owned by the cursor.
+	int isBatch;
+	goVCell *cells;
+	int nRow;
+	int nCol;
+	int iRow;
+	sqlite3_int64 rowid;
 };
 
-uintptr_t goVOpen(void *pVTab, char **pzErr);
+uintptr_t goVOpen(void *pVTab, char **pzErr, int *isBatch);
 
 static int cXOpen(sqlite3_vtab *pVTab, sqlite3_vtab_cursor **ppCursor) {
-	void *vTabCursor = (void *)goVOpen(((goVTab*)pVTab)->vTab, &(pVTab->zErrMsg));
+	int isBatch = 0;
+	void *vTabCursor = (void *)goVOpen(((goVTab*)pVTab)->vTab, &(pVTab->zErrMsg), &isBatch);
 	if (!vTabCursor) {
 		return SQLITE_ERROR;
 	}
@@ -115,6 +136,7 @@ static int cXOpen(sqlite3_vtab *pVTab, sqlite3_vtab_cursor **ppCursor) {
 	}
 	memset(pCursor, 0, sizeof(goVTabCursor));
 	pCursor->vTabCursor = vTabCursor;
+	pCursor->isBatch = isBatch;
 	*ppCursor = (sqlite3_vtab_cursor *)pCursor;
 	return SQLITE_OK;
 }
@@ -126,31 +148,66 @@ static int setErrMsg(sqlite3_vtab_cursor *pCursor, char *pzErr) {
 	return SQLITE_ERROR;
 }
 
+static void freeBatch(goVTabCursor *pCursor) {
+	sqlite3_free(pCursor->cells);
+	pCursor->cells = 0;
+	pCursor->nRow = 0;
+	pCursor->nCol = 0;
+	pCursor->iRow = 0;
+}
+
+char* goVNextBatch(void *pCursor, goVCell **pCells, int *nRow, int *nCol);
+
+static int loadBatch(goVTabCursor *pCursor) {
+	freeBatch(pCursor);
+	char *pzErr = goVNextBatch(pCursor->vTabCursor, &pCursor->cells, &pCursor->nRow, &pCursor->nCol);
+	if (pzErr) {
+		return setErrMsg(&pCursor->base, pzErr);
+	}
+	return SQLITE_OK;
+}
+
 char* goVClose(void *pCursor);
 
 static int cXClose(sqlite3_vtab_cursor *pCursor) {
 	char *pzErr = goVClose(((goVTabCursor*)pCursor)->vTabCursor);
+	int rc = SQLITE_OK;
 	if (pzErr) {
-		return setErrMsg(pCursor, pzErr);
+		rc = setErrMsg(pCursor, pzErr);
 	}
+	// SQLite does not call xClose again, even if it fails
+	freeBatch((goVTabCursor*)pCursor);
 	sqlite3_free(pCursor);
-	return SQLITE_OK;
+	return rc;
 }
 
 char* goVFilter(void *pCursor, int idxNum, char* idxName, int argc, sqlite3_value **argv);
 
 static int cXFilter(sqlite3_vtab_cursor *pCursor, int idxNum, const char *idxStr, int argc, sqlite3_value **argv) {
-	char *pzErr = goVFilter(((goVTabCursor*)pCursor)->vTabCursor, idxNum, (char*)idxStr, argc, argv);
+	goVTabCursor *pCur = (goVTabCursor*)pCursor;
+	char *pzErr = goVFilter(pCur->vTabCursor, idxNum, (char*)idxStr, argc, argv);
 	if (pzErr) {
 		return setErrMsg(pCursor, pzErr);
 	}
+	if (pCur->isBatch) {
+		pCur->rowid = 0;
+		return loadBatch(pCur);
+	}
 	return SQLITE_OK;
 }
 
 char* goVNext(void *pCursor);
 
 static int cXNext(sqlite3_vtab_cursor *pCursor) {
-	char *pzErr = goVNext(((goVTabCursor*)pCursor)->vTabCursor);
+	goVTabCursor *pCur = (goVTabCursor*)pCursor;
+	if (pCur->isBatch) {
+		pCur->rowid++;
+		if (++pCur->iRow < pCur->nRow) {
+			return SQLITE_OK;
+		}
+		return loadBatch(pCur);
+	}
+	char *pzErr = goVNext(pCur->vTabCursor);
 	if (pzErr) {
 		return setErrMsg(pCursor, pzErr);
 	}
@@ -160,17 +217,47 @@ static int cXNext(sqlite3_vtab_cursor *pCursor) {
 int goVEof(void *pCursor);
 
 static inline int cXEof(sqlite3_vtab_cursor *pCursor) {
-	return goVEof(((goVTabCursor*)pCursor)->vTabCursor);
+	goVTabCursor *pCur = (goVTabCursor*)pCursor;
+	if (pCur->isBatch) {
+		return pCur->iRow >= pCur->nRow;
+	}
+	return goVEof(pCur->vTabCursor);
 }
 
 char* goVColumn(void *pCursor, void *cp, int col, int nochange);
 
 static int cXColumn(sqlite3_vtab_cursor *pCursor, sqlite3_context *ctx, int i) {
+	goVTabCursor *pCur = (goVTabCursor*)pCursor;
+	if (pCur->isBatch) {
+		if (i < 0 || i >= pCur->nCol) {
+			sqlite3_result_null(ctx);
+			return SQLITE_OK;
+		}
+		goVCell *cell = &pCur->cells[pCur->iRow * pCur->nCol + i];
+		switch (cell->type) {
+		case SQLITE_INTEGER:
+			sqlite3_result_int64(ctx, cell->i);
+			break;
+		case SQLITE_FLOAT:
+			sqlite3_result_double(ctx, cell->d);
+			break;
+		case SQLITE_TEXT:
+			sqlite3_result_text(ctx, cell->p, cell->n, SQLITE_TRANSIENT);
+			break;
+		case SQLITE_BLOB:
+			sqlite3_result_blob(ctx, cell->p, cell->n, SQLITE_TRANSIENT);
+			break;
+		default:
+			sqlite3_result_null(ctx);
+		}
+		return SQLITE_OK;
+	}
+
 	// Check if int sqlite3_vtab_nochange(sqlite3_context*) returns 1
 	// If it does, warn goVColumn that the value has not changed
 	int nochange = sqlite3_vtab_nochange(ctx);
 
-	char *pzErr = goVColumn(((goVTabCursor*)pCursor)->vTabCursor, ctx, i, nochange);
+	char *pzErr = goVColumn(pCur->vTabCursor, ctx, i, nochange);
 
 	if (pzErr) {
 		return setErrMsg(pCursor, pzErr);
@@ -181,29 +268,43 @@ static int cXColumn(sqlite3_vtab_cursor *pCursor, sqlite3_context *ctx, int i) {
 char* goVRowid(void *pCursor, sqlite3_int64 *pRowid);
 
 static int cXRowid(sqlite3_vtab_cursor *pCursor, sqlite3_int64 *pRowid) {
-	char *pzErr = goVRowid(((goVTabCursor*)pCursor)->vTabCursor, pRowid);
+	goVTabCursor *pCur = (goVTabCursor*)pCursor;
+	if (pCur->isBatch) {
+		*pRowid = pCur->rowid;
+		return SQLITE_OK;
+	}
+	char *pzErr = goVRowid(pCur->vTabCursor, pRowid);
 	if (pzErr) {
 		return setErrMsg(pCursor, pzErr);
 	}
 	return SQLITE_OK;
 }
 
-char* goVUpdate(void *pVTab, int argc, sqlite3_value **argv, sqlite3_int64 *pRowid);
+char* goVUpdate(void *pVTab, int argc, sqlite3_value **argv, sqlite3_int64 *pRowid, int *rc);
 
 int sqlite3_vtab_nochange(sqlite3_context*);
 int sqlite3_value_nochange(sqlite3_value*);
 
 static int cXUpdate(sqlite3_vtab *pVTab, int argc, sqlite3_value **argv, sqlite3_int64 *pRowid) {
-	char *pzErr = goVUpdate(((goVTab*)pVTab)->vTab, argc, argv, pRowid);
+	int rc = SQLITE_ERROR;
+	char *pzErr = goVUpdate(((goVTab*)pVTab)->vTab, argc, argv, pRowid, &rc);
 	if (pzErr) {
 		if (pVTab->zErrMsg)
 			sqlite3_free(pVTab->zErrMsg);
 		pVTab->zErrMsg = pzErr;
-		return SQLITE_ERROR;
+		return rc;
 	}
 	return SQLITE_OK;
 }
 
+// sqlite3_vtab_config is variadic, which cgo does not support.
+static int _sqlite3_vtab_config(sqlite3 *db, int op) {
+	if (op == SQLITE_VTAB_CONSTRAINT_SUPPORT) {
+		return sqlite3_vtab_config(db, op, 1);
+	}
+	return sqlite3_vtab_config(db, op);
+}
+
 char * goVBegin(void *pVTab);
 
 static int cXBegin(sqlite3_vtab *pVTab) {
@@ -243,133 +344,322 @@ static int cXRollback(sqlite3_vtab *pVTab) {
 	return SQLITE_OK;
 }
 
-static sqlite3_module goModule = {
-	0,                       // iVersion
-	cXCreate,                // xCreate - create a table
-	cXConnect,               // xConnect - connect to an existing table
-	cXBestIndex,             // xBestIndex - Determine search strategy
-	cXDisconnect,            // xDisconnect - Disconnect from a table
-	cXDestroy,               // xDestroy - Drop a table
-	cXOpen,                  // xOpen - open a cursor
-	cXClose,                 // xClose - close a cursor
-	cXFilter,                // xFilter - configure scan constraints
-	cXNext,                  // xNext - advance a cursor
-	cXEof,                   // xEof
-	cXColumn,                // xColumn - read data
-	cXRowid,                 // xRowid - read data
-	cXUpdate,                // xUpdate - write data
-// Not implemented
-	0,                       // xBegin - begin transaction
-	0,                       // xSync - sync transaction
-	0,                       // xCommit - commit transaction
-	0,                       // xRollback - rollback transaction
-	0,                       // xFindFunction - function overloading
-	0,                       // xRename - rename the table
-	0,                       // xSavepoint
-	0,                       // xRelease
-	0	                     // xRollbackTo
-};
+void goVFunction(sqlite3_context*, int, sqlite3_value**);
+int goVFindFunction(void *pVTab, int nArg, char *zName, void **ppArg);
 
-// See https://sqlite.org/vtab.html#eponymous_only_virtual_tables
-static sqlite3_module goModuleEponymousOnly = {
-	0,                       // iVersion
-	0,                       // xCreate - create a table, which here is null
-	cXConnect,               // xConnect - connect to an existing table
-	cXBestIndex,             // xBestIndex - Determine search strategy
-	cXDisconnect,            // xDisconnect - Disconnect from a table
-	cXDestroy,               // xDestroy - Drop a table
-	cXOpen,                  // xOpen - open a cursor
-	cXClose,                 // xClose - close a cursor
-	cXFilter,                // xFilter - configure scan constraints
-	cXNext,                  // xNext - advance a cursor
-	cXEof,                   // xEof
-	cXColumn,                // xColumn - read data
-	cXRowid,                 // xRowid - read data
-	cXUpdate,                // xUpdate - write data
-// Not implemented
-	0,                       // xBegin - begin transaction
-	0,                       // xSync - sync transaction
-	0,                       // xCommit - commit transaction
-	0,                       // xRollback - rollback transaction
-	0,                       // xFindFunction - function overloading
-	0,                       // xRename - rename the table
-	0,                       // xSavepoint
-	0,                       // xRelease
-	0	                     // xRollbackTo
-};
+static int cXFindFunction(sqlite3_vtab *pVTab, int nArg, const char *zName, void (**pxFunc)(sqlite3_context*,int,sqlite3_value**), void **ppArg) {
+	int rc = goVFindFunction(((goVTab*)pVTab)->vTab, nArg, (char*)zName, ppArg);
+	if (rc) {
+		*pxFunc = goVFunction;
+	}
+	return rc;
+}
 
-static sqlite3_module goModuleTransaction = {
-	0,                       // iVersion
-	cXCreate,                // xCreate - create a table
-	cXConnect,               // xConnect - connect to an existing table
-	cXBestIndex,             // xBestIndex - Determine search strategy
-	cXDisconnect,            // xDisconnect - Disconnect from a table
-	cXDestroy,               // xDestroy - Drop a table
-	cXOpen,                  // xOpen - open a cursor
-	cXClose,                 // xClose - close a cursor
-	cXFilter,                // xFilter - configure scan constraints
-	cXNext,                  // xNext - advance a cursor
-	cXEof,                   // xEof
-	cXColumn,                // xColumn - read data
-	cXRowid,                 // xRowid - read data
-	cXUpdate,                // xUpdate - write data
-	cXBegin,                 // xBegin - begin transaction
-	0,                       // xSync - sync transaction
-	cXCommit,                // xCommit - commit transaction
-	cXRollback,              // xRollback - rollback transaction
-	0,                       // xFindFunction - function overloading
-	0,                       // xRename - rename the table
-	0,                       // xSavepoint
-	0,                       // xRelease
-	0	                     // xRollbackTo
-};
+char * goVRename(void *pVTab, char *zNew);
 
-void goMDestroy(void*);
+static int cXRename(sqlite3_vtab *pVTab, const char *zNew) {
+	char *pzErr = goVRename(((goVTab*)pVTab)->vTab, (char*)zNew);
+	if (pzErr) {
+		if (pVTab->zErrMsg)
+			sqlite3_free(pVTab->zErrMsg);
+		pVTab->zErrMsg = pzErr;
+		return SQLITE_ERROR;
+	}
+	return SQLITE_OK;
+}
+
+#if SQLITE_VERSION_NUMBER >= 3044000
+char * goVIntegrity(void *pVTab, char *zSchema, char *zTabName, int mFlags, char **pzErr);
+
+static int cXIntegrity(sqlite3_vtab *pVTab, const char *zSchema, const char *zTabName, int mFlags, char **pzErr) {
+	char *zErr = goVIntegrity(((goVTab*)pVTab)->vTab, (char*)zSchema, (char*)zTabName, mFlags, pzErr);
+	if (zErr) {
+		if (pVTab->zErrMsg)
+			sqlite3_free(pVTab->zErrMsg);
+		pVTab->zErrMsg = zErr;
+		return SQLITE_ERROR;
+	}
+	return SQLITE_OK;
+}
+#endif
+
+char * goVSync(void *pVTab);
+
+static int cXSync(sqlite3_vtab *pVTab) {
+	char *pzErr = goVSync(((goVTab*)pVTab)->vTab);
+	if (pzErr) {
+		if (pVTab->zErrMsg)
+			sqlite3_free(pVTab->zErrMsg);
+		pVTab->zErrMsg = pzErr;
+		return SQLITE_ERROR;
+	}
+	return SQLITE_OK;
+}
+
+char * goVSavepoint(void *pVTab, int n);
+
+static int cXSavepoint(sqlite3_vtab *pVTab, int n) {
+	char *pzErr = goVSavepoint(((goVTab*)pVTab)->vTab, n);
+	if (pzErr) {
+		if (pVTab->zErrMsg)
+			sqlite3_free(pVTab->zErrMsg);
+		pVTab->zErrMsg = pzErr;
+		return SQLITE_ERROR;
+	}
+	return SQLITE_OK;
+}
+
+char * goVReleaseSavepoint(void *pVTab, int n);
 
-static int _sqlite3_create_module(sqlite3 *db, const char *zName, uintptr_t pClientData) {
-  return sqlite3_create_module_v2(db, zName, &goModule, (void*) pClientData, goMDestroy);
+static int cXReleaseSavepoint(sqlite3_vtab *pVTab, int n) {
+	char *pzErr = goVReleaseSavepoint(((goVTab*)pVTab)->vTab, n);
+	if (pzErr) {
+		if (pVTab->zErrMsg)
+			sqlite3_free(pVTab->zErrMsg);
+		pVTab->zErrMsg = pzErr;
+		return SQLITE_ERROR;
+	}
+	return SQLITE_OK;
 }
 
-static int _sqlite3_create_module_eponymous_only(sqlite3 *db, const char *zName, uintptr_t pClientData) {
-  return sqlite3_create_module_v2(db, zName, &goModuleEponymousOnly, (void*) pClientData, goMDestroy);
+char * goVRollbackTo(void *pVTab, int n);
+
+static int cXRollbackTo(sqlite3_vtab *pVTab, int n) {
+	char *pzErr = goVRollbackTo(((goVTab*)pVTab)->vTab, n);
+	if (pzErr) {
+		if (pVTab->zErrMsg)
+			sqlite3_free(pVTab->zErrMsg);
+		pVTab->zErrMsg = pzErr;
+		return SQLITE_ERROR;
+	}
+	return SQLITE_OK;
 }
 
-static int _sqlite3_create_module_transaction(sqlite3 *db, const char *zName, uintptr_t pClientData) {
-  return sqlite3_create_module_v2(db, zName, &goModuleTransaction, (void*) pClientData, goMDestroy);
+// xShadowName has no context argument, so every distinct set of shadow
+// table names gets its own function, out of a fixed pool.
+#define GO_SHADOW_NAME_SLOTS 32
+
+int goMShadowName(int slot, char *zName);
+
+#define GO_SHADOW_NAME(n) \
+static int cXShadowName##n(const char *zName) { \
+	return goMShadowName(n, (char*)zName); \
+}
+
+GO_SHADOW_NAME(0)
+GO_SHADOW_NAME(1)
+GO_SHADOW_NAME(2)
+GO_SHADOW_NAME(3)
+GO_SHADOW_NAME(4)
+GO_SHADOW_NAME(5)
+GO_SHADOW_NAME(6)
+GO_SHADOW_NAME(7)
+GO_SHADOW_NAME(8)
+GO_SHADOW_NAME(9)
+GO_SHADOW_NAME(10)
+GO_SHADOW_NAME(11)
+GO_SHADOW_NAME(12)
+GO_SHADOW_NAME(13)
+GO_SHADOW_NAME(14)
+GO_SHADOW_NAME(15)
+GO_SHADOW_NAME(16)
+GO_SHADOW_NAME(17)
+GO_SHADOW_NAME(18)
+GO_SHADOW_NAME(19)
+GO_SHADOW_NAME(20)
+GO_SHADOW_NAME(21)
+GO_SHADOW_NAME(22)
+GO_SHADOW_NAME(23)
+GO_SHADOW_NAME(24)
+GO_SHADOW_NAME(25)
+GO_SHADOW_NAME(26)
+GO_SHADOW_NAME(27)
+GO_SHADOW_NAME(28)
+GO_SHADOW_NAME(29)
+GO_SHADOW_NAME(30)
+GO_SHADOW_NAME(31)
+
+static int (*goShadowNames[GO_SHADOW_NAME_SLOTS])(const char*) = {
+	cXShadowName0,
+	cXShadowName1,
+	cXShadowName2,
+	cXShadowName3,
+	cXShadowName4,
+	cXShadowName5,
+	cXShadowName6,
+	cXShadowName7,
+	cXShadowName8,
+	cXShadowName9,
+	cXShadowName10,
+	cXShadowName11,
+	cXShadowName12,
+	cXShadowName13,
+	cXShadowName14,
+	cXShadowName15,
+	cXShadowName16,
+	cXShadowName17,
+	cXShadowName18,
+	cXShadowName19,
+	cXShadowName20,
+	cXShadowName21,
+	cXShadowName22,
+	cXShadowName23,
+	cXShadowName24,
+	cXShadowName25,
+	cXShadowName26,
+	cXShadowName27,
+	cXShadowName28,
+	cXShadowName29,
+	cXShadowName30,
+	cXShadowName31
+};
+
+// Capabilities of a module, see moduleCapabilities.
+#define GO_MODULE_EPONYMOUS      0x01
+#define GO_MODULE_EPONYMOUS_ONLY 0x02
+#define GO_MODULE_TRANSACTION    0x04
+
+// _sqlite3_new_module returns a module whose optional callbacks are set
+// according to caps, and whose shadow table names are checked by the
+// function of shadowSlot, if not negative. It is freed with sqlite3_free
+// when the module is destroyed.
+static sqlite3_module *_sqlite3_new_module(int caps, int shadowSlot) {
+	sqlite3_module *pModule = (sqlite3_module *)sqlite3_malloc(sizeof(sqlite3_module));
+	if (!pModule) {
+		return 0;
+	}
+	memset(pModule, 0, sizeof(sqlite3_module));
+	pModule->iVersion = 1;
+	if (caps & GO_MODULE_EPONYMOUS_ONLY) {
+		// See https://sqlite.org/vtab.html#eponymous_only_virtual_tables
+		pModule->xCreate = 0;
+	} else if (caps & GO_MODULE_EPONYMOUS) {
+		// See https://sqlite.org/vtab.html#eponymous_virtual_tables
+		pModule->xCreate = cXConnect;
+	} else {
+		pModule->xCreate = cXCreate;
+	}
+	pModule->xConnect = cXConnect;
+	pModule->xBestIndex = cXBestIndex;
+	pModule->xDisconnect = cXDisconnect;
+	pModule->xDestroy = cXDestroy;
+	pModule->xOpen = cXOpen;
+	pModule->xClose = cXClose;
+	pModule->xFilter = cXFilter;
+	pModule->xNext = cXNext;
+	pModule->xEof = cXEof;
+	pModule->xColumn = cXColumn;
+	pModule->xRowid = cXRowid;
+	pModule->xUpdate = cXUpdate;
+	// no-ops for tables that do not overload functions or handle renames
+	pModule->xFindFunction = cXFindFunction;
+	pModule->xRename = cXRename;
+	if (caps & GO_MODULE_TRANSACTION) {
+		pModule->xBegin = cXBegin;
+		pModule->xSync = cXSync;
+		pModule->xCommit = cXCommit;
+		pModule->xRollback = cXRollback;
+		// savepoints are only opened within a transaction
+		pModule->iVersion = 2;
+		pModule->xSavepoint = cXSavepoint;
+		pModule->xRelease = cXReleaseSavepoint;
+		pModule->xRollbackTo = cXRollbackTo;
+	}
+	if (shadowSlot >= 0 && shadowSlot < GO_SHADOW_NAME_SLOTS) {
+		pModule->iVersion = 3;
+		pModule->xShadowName = goShadowNames[shadowSlot];
+	}
+#if SQLITE_VERSION_NUMBER >= 3044000
+	// a no-op for tables that do not check their integrity
+	pModule->iVersion = 4;
+	pModule->xIntegrity = cXIntegrity;
+#endif
+	return pModule;
+}
+
+void goMDestroy(void*);
+
+static int _sqlite3_create_module(sqlite3 *db, const char *zName, const sqlite3_module *pModule, uintptr_t pClientData) {
+  return sqlite3_create_module_v2(db, zName, pModule, (void*) pClientData, goMDestroy);
 }
 
 static int _sqlite3_drop_modules(sqlite3 *db, const char **azKeep) {
   return sqlite3_drop_modules(db, azKeep);
 }
 
+// sqlite3_declare_vtab does not report a WITHOUT ROWID table whose key is
+// not a single column, which must not be mistaken for the previous error.
+static int _sqlite3_declare_vtab(sqlite3 *db, const char *zSql) {
+	sqlite3_stmt *pStmt = 0;
+	// preparing nothing clears the error of db
+	sqlite3_prepare_v2(db, "", -1, &pStmt, 0);
+	return sqlite3_declare_vtab(db, zSql);
+}
+
 */
 import "C"
 
 import (
+	"context"
 	"database/sql/driver"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
+// vtabConn is the state of the virtual tables of a connection.
+type vtabConn struct {
+	// gen is the generation of the virtual table schemas, incremented by
+	// InvalidateVTabSchemas
+	gen          uint64
+	interceptors vtabInterceptors
+}
+
 type sqliteModule struct {
-	c      *SQLiteConn
-	name   string
-	module Module
+	c       *SQLiteConn
+	name    string
+	module  Module
+	pModule *C.sqlite3_module
+	// chain are the interceptors of the tables of the module, nil if
+	// there are none
+	chain atomic.Pointer[[]VTabInterceptor]
+	// eponymous is the number of eponymous tables connected, which
+	// InvalidateVTabSchemas cannot reconnect
+	eponymous int
+	// invalidated is the generation of the last invalidation of the
+	// schemas of the tables, for the statements prepared before to fail
+	invalidated uint64
 }
 
 type sqliteVTab struct {
 	module        *sqliteModule
+	schema        string
+	table         string
 	vTab          VTab
 	partialUpdate bool
+	eponymous     bool
+	// funcs are the handles of the functions returned by FindFunction,
+	// by number of arguments and name.
+	funcs map[string]unsafe.Pointer
 }
 
 type sqliteVTabCursor struct {
 	vTab          *sqliteVTab
 	vTabCursor    VTabCursor
 	partialUpdate bool
+	// rows is the number of rows returned, reported to interceptors
+	rows int64
+	// eofErr is the panic of EOF, which cannot fail, returned by the next
+	// call to Column, Rowid or Next instead
+	eofErr error
 }
 
 // Op is type of operations.
@@ -377,24 +667,51 @@ type Op uint8
 
 // Op mean identity of operations.
 const (
-	OpEQ     Op = 2
-	OpGT        = 4
-	OpLE        = 8
-	OpLT        = 16
-	OpGE        = 32
-	OpMATCH     = 64
-	OpLIKE      = 65 /* 3.10.0 and later only */
-	OpGLOB      = 66 /* 3.10.0 and later only */
-	OpREGEXP    = 67 /* 3.10.0 and later only */
-	OpLIMIT     = 73
-	OpOFFSET    = 74
+	OpEQ        Op = 2
+	OpGT           = 4
+	OpLE           = 8
+	OpLT           = 16
+	OpGE           = 32
+	OpMATCH        = 64
+	OpLIKE         = 65 /* 3.10.0 and later only */
+	OpGLOB         = 66 /* 3.10.0 and later only */
+	OpREGEXP       = 67 /* 3.10.0 and later only */
+	OpNE           = 68 /* 3.21.0 and later only */
+	OpISNOT        = 69 /* 3.21.0 and later only */
+	OpISNOTNULL    = 70 /* 3.21.0 and later only */
+	OpISNULL       = 71 /* 3.21.0 and later only */
+	OpIS           = 72 /* 3.21.0 and later only */
+	OpLIMIT        = 73
+	OpOFFSET       = 74
+	OpFUNCTION     = 150 /* 3.25.0 and later only */
 )
 
+// Unary reports whether the operation has no right-hand side operand.
+// The Filter argument of a used unary constraint is always nil.
+func (op Op) Unary() bool {
+	return op == OpISNULL || op == OpISNOTNULL
+}
+
 // InfoConstraint give information of constraint.
 type InfoConstraint struct {
 	Column int
 	Op     Op
 	Usable bool
+	// RHS is the right-hand side value of the constraint when SQLite
+	// knows it at planning time (e.g. the literal in `WHERE col = 'x'`).
+	// HasRHS reports whether RHS is available; a NULL literal is
+	// reported as a nil RHS with HasRHS set to true.
+	// See: https://sqlite.org/c3ref/vtab_rhs_value.html
+	RHS    any
+	HasRHS bool
+	// In reports whether the constraint is an IN operator that SQLite
+	// can hand over all at once. See IndexResult.In.
+	// See: https://sqlite.org/c3ref/vtab_in.html
+	In bool
+	// Collation is the name of the collating sequence used to evaluate
+	// the constraint, e.g. "BINARY" or "NOCASE".
+	// See: https://sqlite.org/c3ref/vtab_collation.html
+	Collation string
 }
 
 // InfoOrderBy give information of order-by.
@@ -411,20 +728,86 @@ func constraints(info *C.sqlite3_index_info) []InfoConstraint {
 	}))
 
 	cst := make([]InfoConstraint, 0, len(slice))
-	for _, c := range slice {
+	for i, c := range slice {
 		var usable bool
 		if c.usable > 0 {
 			usable = true
 		}
+		var rhs any
+		var hasRHS bool
+		if !Op(c.op).Unary() {
+			rhs, hasRHS = rhsValue(info, i)
+		}
 		cst = append(cst, InfoConstraint{
-			Column: int(c.iColumn),
-			Op:     Op(c.op),
-			Usable: usable,
+			Column:    int(c.iColumn),
+			Op:        Op(c.op),
+			Usable:    usable,
+			RHS:       rhs,
+			HasRHS:    hasRHS,
+			In:        C.sqlite3_vtab_in(info, C.int(i), -1) != 0,
+			Collation: C.GoString(C.sqlite3_vtab_collation(info, C.int(i))),
 		})
 	}
 	return cst
 }
 
+// rhsValue returns the right-hand side value of the i-th constraint
+// if it is available at planning time.
+func rhsValue(info *C.sqlite3_index_info, i int) (any, bool) {
+	var val *C.sqlite3_value
+	if C.sqlite3_vtab_rhs_value(info, C.int(i), &val) != C.SQLITE_OK || val == nil {
+		return nil, false
+	}
+	x, err := valueToGo(val)
+	if err != nil {
+		return nil, false
+	}
+	return x, true
+}
+
+// valueToGo converts a sqlite3_value to its Go representation,
+// reporting SQL NULL as nil.
+func valueToGo(v *C.sqlite3_value) (any, error) {
+	conv, err := callbackArgGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	// work around for SQLITE_NULL
+	x := conv.Interface()
+	if z, ok := x.([]byte); ok && z == nil {
+		x = nil
+	}
+	return x, nil
+}
+
+// inValues returns all the values on the right-hand side of an IN
+// constraint selected for all-at-once processing in BestIndex.
+// It reports false if v is not such a value.
+func inValues(v *C.sqlite3_value) ([]any, bool, error) {
+	// IN lists appear as NULL values to anything but sqlite3_vtab_in_first
+	if C.sqlite3_value_type(v) != C.SQLITE_NULL {
+		return nil, false, nil
+	}
+	var val *C.sqlite3_value
+	rc := C.sqlite3_vtab_in_first(v, &val)
+	if rc == C.SQLITE_ERROR || rc == C.SQLITE_MISUSE {
+		// Older SQLite versions report SQLITE_MISUSE for plain values
+		return nil, false, nil
+	}
+	vals := make([]any, 0)
+	for ; rc == C.SQLITE_OK && val != nil; rc = C.sqlite3_vtab_in_next(v, &val) {
+		x, err := valueToGo(val)
+		if err != nil {
+			return nil, true, err
+		}
+		vals = append(vals, x)
+	}
+	if rc != C.SQLITE_OK && rc != C.SQLITE_DONE {
+		return nil, true, ErrNo(rc)
+	}
+	return vals, true, nil
+}
+
 func orderBys(info *C.sqlite3_index_info) []InfoOrderBy {
 	slice := *(*[]C.struct_sqlite3_index_orderby)(unsafe.Pointer(&reflect.SliceHeader{
 		Data: uintptr(unsafe.Pointer(info.aOrderBy)),
@@ -456,6 +839,23 @@ type IndexResult struct {
 	AlreadyOrdered bool // orderByConsumed
 	EstimatedCost  float64
 	EstimatedRows  float64
+	// In asks SQLite to pass the whole right-hand side of used IN
+	// constraints (InfoConstraint.In) as a single []any argument to
+	// VTabCursor.Filter, instead of calling Filter once per value.
+	In []bool
+	// ScanUnique tells SQLite that the plan returns at most one row
+	// (SQLITE_INDEX_SCAN_UNIQUE in idxFlags).
+	ScanUnique bool
+	// Omit tells SQLite, per used constraint, that the virtual table
+	// fully enforces it so SQLite does not need to evaluate it again on
+	// every returned row (aConstraintUsage.omit).
+	// When Omit is nil, SQLite re-checks every used constraint but OFFSET.
+	Omit []bool
+	// ArgvIndex optionally sets, per used constraint, the position from 1
+	// of its value in the arguments of Filter (aConstraintUsage.argvIndex).
+	// The positions of the used constraints must be 1 to their number.
+	// When ArgvIndex is nil, the arguments follow the constraints.
+	ArgvIndex []int
 }
 
 // mPrintf is a utility wrapper around sqlite3_mprintf
@@ -467,8 +867,17 @@ func mPrintf(format, arg string) *C.char {
 	return C._sqlite3_mprintf(cf, ca)
 }
 
+// vtabRecover reports a panic of the virtual table callback of handle as
+// the error message *pzErr. It must be deferred.
+func vtabRecover(handle unsafe.Pointer, pzErr **C.char) {
+	if r := recover(); r != nil {
+		*pzErr = mPrintf("%s", newPanicError(lookupHandleVal(handle).db, r).Error())
+	}
+}
+
 //export goMInit
 func goMInit(db, pClientData unsafe.Pointer, argc C.int, argv **C.char, pzErr **C.char, isCreate C.int) C.uintptr_t {
+	defer vtabRecover(pClientData, pzErr)
 	m := lookupHandle(pClientData).(*sqliteModule)
 	if m.c.db != (*C.sqlite3)(db) {
 		*pzErr = mPrintf("%s", "Inconsistent db handles")
@@ -482,35 +891,58 @@ func goMInit(db, pClientData unsafe.Pointer, argc C.int, argv **C.char, pzErr **
 		args[i] = C.GoString(s)
 	}
 	var vTab VTab
-	var err error
+	call := &VTabCall{Method: "Connect"}
 	if isCreate == 1 {
-		vTab, err = m.module.Create(m.c, args)
-	} else {
-		vTab, err = m.module.Connect(m.c, args)
+		call.Method = "Create"
 	}
+	// args are the module, schema and table names, then the arguments
+	err := m.intercept(args[1], args[2], call, func() (err error) {
+		if isCreate == 1 {
+			vTab, err = m.module.Create(m.c, args)
+		} else {
+			vTab, err = m.module.Connect(m.c, args)
+		}
+		return err
+	})
 
 	if err != nil {
 		*pzErr = mPrintf("%s", err.Error())
 		return 0
 	}
 	partialUpdate := false
-	if up, ok := vTab.(VTabUpdater); ok {
+	if _, ok := vTab.(VTabRequestUpdater); ok {
+		partialUpdate = true
+	} else if up, ok := vTab.(VTabUpdater); ok {
 		partialUpdate = up.PartialUpdate()
 	}
-	vt := sqliteVTab{m, vTab, partialUpdate}
+	vt := sqliteVTab{module: m, schema: args[1], table: args[2], vTab: vTab, partialUpdate: partialUpdate}
+	// eponymous tables are connected in main, and named after their module
+	if moduleCapabilities(m.module)&(C.GO_MODULE_EPONYMOUS_ONLY|C.GO_MODULE_EPONYMOUS) != 0 &&
+		isCreate == 0 && args[1] == "main" && strings.EqualFold(args[2], m.name) {
+		vt.eponymous = true
+		m.eponymous++
+	}
 	*pzErr = nil
 	return C.uintptr_t(uintptr(newHandle(m.c, &vt)))
 }
 
 //export goVRelease
-func goVRelease(pVTab unsafe.Pointer, isDestroy C.int) *C.char {
+func goVRelease(pVTab unsafe.Pointer, isDestroy C.int) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
 	vt := lookupHandle(pVTab).(*sqliteVTab)
-	var err error
+	if vt.eponymous {
+		vt.module.eponymous--
+	}
+	call := &VTabCall{Method: "Disconnect"}
 	if isDestroy == 1 {
-		err = vt.vTab.Destroy()
-	} else {
-		err = vt.vTab.Disconnect()
+		call.Method = "Destroy"
 	}
+	err := vt.intercept(call, func() error {
+		if isDestroy == 1 {
+			return vt.vTab.Destroy()
+		}
+		return vt.vTab.Disconnect()
+	})
 	if err != nil {
 		return mPrintf("%s", err.Error())
 	}
@@ -518,25 +950,91 @@ func goVRelease(pVTab unsafe.Pointer, isDestroy C.int) *C.char {
 }
 
 //export goVOpen
-func goVOpen(pVTab unsafe.Pointer, pzErr **C.char) C.uintptr_t {
+func goVOpen(pVTab unsafe.Pointer, pzErr **C.char, isBatch *C.int) C.uintptr_t {
+	defer vtabRecover(pVTab, pzErr)
 	vt := lookupHandle(pVTab).(*sqliteVTab)
-	vTabCursor, err := vt.vTab.Open()
+	if err := vt.checkSchema(); err != nil {
+		*pzErr = mPrintf("%s", err.Error())
+		return 0
+	}
+	var vTabCursor VTabCursor
+	var err error
+	if vt.module.intercepted() {
+		vTabCursor, err = vt.interceptOpen()
+	} else {
+		vTabCursor, err = vt.vTab.Open()
+	}
 	if err != nil {
 		*pzErr = mPrintf("%s", err.Error())
 		return 0
 	}
-	vtc := sqliteVTabCursor{vt, vTabCursor, vt.partialUpdate}
+	if _, ok := vTabCursor.(VTabCursorBatch); ok {
+		// UPDATE and DELETE would receive positions instead of rowids
+		if vt.writable() {
+			vTabCursor.Close()
+			*pzErr = mPrintf("virtual %s table cannot use a batch cursor as it is writable", vt.module.name)
+			return 0
+		}
+		*isBatch = 1
+	}
+	vtc := sqliteVTabCursor{vTab: vt, vTabCursor: vTabCursor, partialUpdate: vt.partialUpdate}
 	*pzErr = nil
 	return C.uintptr_t(uintptr(newHandle(vt.module.c, &vtc)))
 }
 
+// interceptOpen opens a cursor through the interceptors of vt.
+func (vt *sqliteVTab) interceptOpen() (vTabCursor VTabCursor, err error) {
+	err = vt.intercept(&VTabCall{Method: "Open"}, func() (err error) {
+		vTabCursor, err = vt.vTab.Open()
+		return err
+	})
+	return vTabCursor, err
+}
+
+// checkSchema fails if the statement being stepped was prepared before the
+// schemas of the tables of the module of vt were invalidated, which makes
+// the step fail with ErrSchema.
+func (vt *sqliteVTab) checkSchema() error {
+	sc := vt.module.c.stepStmt
+	if sc == nil || sc.vtabGen >= vt.module.invalidated {
+		return nil
+	}
+	sc.schemaChanged = true
+	return fmt.Errorf("sqlite3: schema of virtual table %s changed since the statement was prepared", vt.table)
+}
+
+// writable reports whether vt implements VTabUpdater or VTabRequestUpdater.
+func (vt *sqliteVTab) writable() bool {
+	switch vt.vTab.(type) {
+	case VTabUpdater, VTabRequestUpdater:
+		return true
+	}
+	return false
+}
+
 //export goVBestIndex
-func goVBestIndex(pVTab unsafe.Pointer, icp unsafe.Pointer, pzErr **C.char) C.int {
+func goVBestIndex(pVTab unsafe.Pointer, icp unsafe.Pointer, pzErr **C.char) (rc C.int) {
+	defer func() {
+		if r := recover(); r != nil {
+			if *pzErr != nil {
+				C.sqlite3_free(unsafe.Pointer(*pzErr))
+			}
+			*pzErr = mPrintf("%s", newPanicError(lookupHandleVal(pVTab).db, r).Error())
+			rc = C.SQLITE_ERROR
+		}
+	}()
 	vt := lookupHandle(pVTab).(*sqliteVTab)
 	info := (*C.sqlite3_index_info)(icp)
 	csts := constraints(info)
-	res, err := vt.vTab.BestIndex(csts, orderBys(info), IndexInformation{
-		ColUsed: uint64(info.colUsed),
+	call := &VTabCall{Method: "BestIndex", Constraints: csts, OrderBy: orderBys(info)}
+	var res *IndexResult
+	err := vt.intercept(call, func() (err error) {
+		res, err = vt.vTab.BestIndex(csts, call.OrderBy, IndexInformation{
+			ColUsed:  uint64(info.colUsed),
+			Distinct: int(C.sqlite3_vtab_distinct(info)),
+		})
+		call.Plan = res
+		return err
 	})
 	if err == ErrConstraint {
 		return C.int(ErrConstraint)
@@ -550,9 +1048,24 @@ func goVBestIndex(pVTab unsafe.Pointer, icp unsafe.Pointer, pzErr **C.char) C.in
 		return C.SQLITE_ERROR
 	}
 
+	if res == nil {
+		if *pzErr != nil {
+			C.sqlite3_free(unsafe.Pointer(*pzErr))
+		}
+		*pzErr = mPrintf("%s", "sqlite3: BestIndex returned no index result")
+		return C.SQLITE_ERROR
+	}
 	if len(res.Used) != len(csts) {
 		return C.SQLITE_ERROR
 	}
+	argv, nArg, err := argvIndexes(res)
+	if err != nil {
+		if *pzErr != nil {
+			C.sqlite3_free(unsafe.Pointer(*pzErr))
+		}
+		*pzErr = mPrintf("%s", err.Error())
+		return C.SQLITE_ERROR
+	}
 
 	// Get a pointer to constraint_usage struct so we can update in place.
 
@@ -561,7 +1074,10 @@ func goVBestIndex(pVTab unsafe.Pointer, icp unsafe.Pointer, pzErr **C.char) C.in
 		Len:  int(info.nConstraint),
 		Cap:  int(info.nConstraint),
 	}))
-	index := 1
+	// argMap records the column and operator of each xFilter argument.
+	// It is stored after the NUL terminator of idxStr so goVFilter can
+	// find it again.
+	argMap := make([]byte, nArg*filterArgSize)
 	for i := range slice {
 		if res.Used[i] {
 			// The default library omit value is 1
@@ -577,14 +1093,31 @@ func goVBestIndex(pVTab unsafe.Pointer, icp unsafe.Pointer, pzErr **C.char) C.in
 				omit = C.uchar(1)
 			}
 
-			slice[i].argvIndex = C.int(index)
+			// Modules that filter exactly can opt in per constraint
+			if i < len(res.Omit) && res.Omit[i] {
+				omit = C.uchar(1)
+			}
+
+			slice[i].argvIndex = C.int(argv[i])
 			slice[i].omit = omit
-			index++
+			arg := argMap[(argv[i]-1)*filterArgSize:]
+			arg[0] = byte(csts[i].Op)
+			binary.LittleEndian.PutUint32(arg[1:], uint32(int32(csts[i].Column)))
+
+			if i < len(res.In) && res.In[i] && csts[i].In {
+				C.sqlite3_vtab_in(info, C.int(i), 1)
+			}
 		}
 	}
 
+	// idxStr is a C string, anything after a NUL byte would be lost
+	resIdxStr := res.IdxStr
+	if i := strings.IndexByte(resIdxStr, 0); i >= 0 {
+		resIdxStr = resIdxStr[:i]
+	}
+
 	info.idxNum = C.int(res.IdxNum)
-	info.idxStr = (*C.char)(C.sqlite3_malloc(C.int(len(res.IdxStr) + 1)))
+	info.idxStr = (*C.char)(C.sqlite3_malloc(C.int(len(resIdxStr) + 1 + len(argMap))))
 	if info.idxStr == nil {
 		// C.malloc and C.CString ordinarily do this for you. See https://golang.org/cmd/cgo/
 		panic("out of memory")
@@ -593,25 +1126,64 @@ func goVBestIndex(pVTab unsafe.Pointer, icp unsafe.Pointer, pzErr **C.char) C.in
 
 	idxStr := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
 		Data: uintptr(unsafe.Pointer(info.idxStr)),
-		Len:  len(res.IdxStr) + 1,
-		Cap:  len(res.IdxStr) + 1,
+		Len:  len(resIdxStr) + 1 + len(argMap),
+		Cap:  len(resIdxStr) + 1 + len(argMap),
 	}))
-	copy(idxStr, res.IdxStr)
-	idxStr[len(idxStr)-1] = 0 // null-terminated string
+	copy(idxStr, resIdxStr)
+	idxStr[len(resIdxStr)] = 0 // null-terminated string
+	copy(idxStr[len(resIdxStr)+1:], argMap)
 
 	if res.AlreadyOrdered {
 		info.orderByConsumed = C.int(1)
 	}
+	if res.ScanUnique {
+		info.idxFlags |= C.SQLITE_INDEX_SCAN_UNIQUE
+	}
 	info.estimatedCost = C.double(res.EstimatedCost)
 	info.estimatedRows = C.sqlite3_int64(res.EstimatedRows)
 
 	return 0
 }
 
+// argvIndexes returns the position of the argument of each constraint
+// used by res, from 1, or 0 for the unused ones, and the number of
+// arguments.
+func argvIndexes(res *IndexResult) ([]int, int, error) {
+	argv := make([]int, len(res.Used))
+	n := 0
+	for i, used := range res.Used {
+		if used {
+			n++
+			argv[i] = n
+		}
+	}
+	if res.ArgvIndex == nil {
+		return argv, n, nil
+	}
+	seen := make([]bool, n+1)
+	for i, used := range res.Used {
+		if !used {
+			continue
+		}
+		if i >= len(res.ArgvIndex) || res.ArgvIndex[i] < 1 || res.ArgvIndex[i] > n || seen[res.ArgvIndex[i]] {
+			return nil, 0, fmt.Errorf("sqlite3: the ArgvIndex of the %d used constraints must be 1 to %d", n, n)
+		}
+		seen[res.ArgvIndex[i]] = true
+		argv[i] = res.ArgvIndex[i]
+	}
+	return argv, n, nil
+}
+
 //export goVClose
-func goVClose(pCursor unsafe.Pointer) *C.char {
+func goVClose(pCursor unsafe.Pointer) (pzErr *C.char) {
+	defer vtabRecover(pCursor, &pzErr)
 	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
-	err := vtc.vTabCursor.Close()
+	var err error
+	if vtc.vTab.module.intercepted() {
+		err = vtc.vTab.intercept(&VTabCall{Method: "Close", Rows: vtc.rows}, vtc.vTabCursor.Close)
+	} else {
+		err = vtc.vTabCursor.Close()
+	}
 	if err != nil {
 		return mPrintf("%s", err.Error())
 	}
@@ -620,52 +1192,283 @@ func goVClose(pCursor unsafe.Pointer) *C.char {
 
 //export goMDestroy
 func goMDestroy(pClientData unsafe.Pointer) {
+	defer hookRecover(pClientData)
 	m := lookupHandle(pClientData).(*sqliteModule)
+	// SQLite no longer uses the module once it is destroyed
+	defer C.sqlite3_free(unsafe.Pointer(m.pModule))
+	m.c.vtabs.interceptors.unregister(m)
 	m.module.DestroyModule()
 }
 
 //export goVFilter
-func goVFilter(pCursor unsafe.Pointer, idxNum C.int, idxName *C.char, argc C.int, argv **C.sqlite3_value) *C.char {
+func goVFilter(pCursor unsafe.Pointer, idxNum C.int, idxName *C.char, argc C.int, argv **C.sqlite3_value) (pzErr *C.char) {
+	defer vtabRecover(pCursor, &pzErr)
 	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
 	args := (*[(math.MaxInt32 - 1) / unsafe.Sizeof((*C.sqlite3_value)(nil))]*C.sqlite3_value)(unsafe.Pointer(argv))[:argc:argc]
+	idxStr := C.GoString(idxName)
+	fargs := filterArgs(idxName, len(idxStr), int(argc))
 	vals := make([]any, 0, argc)
-	for _, v := range args {
+	for i, v := range args {
+		if fargs[i].Op.Unary() {
+			vals = append(vals, nil)
+			continue
+		}
+		in, ok, err := inValues(v)
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+		if ok {
+			vals = append(vals, in)
+			continue
+		}
 		conv, err := callbackArgGeneric(v)
 		if err != nil {
 			return mPrintf("%s", err.Error())
 		}
 		vals = append(vals, conv.Interface())
 	}
-	err := vtc.vTabCursor.Filter(int(idxNum), C.GoString(idxName), vals)
+
+	var err error
+	if vtc.vTab.module.intercepted() {
+		call := &VTabCall{Method: "Filter", IdxNum: int(idxNum), IdxStr: idxStr, Args: vals}
+		err = vtc.vTab.intercept(call, func() error {
+			return vtc.filter(int(idxNum), idxStr, vals, fargs)
+		})
+	} else {
+		err = vtc.filter(int(idxNum), idxStr, vals, fargs)
+	}
 	if err != nil {
 		return mPrintf("%s", err.Error())
 	}
 	return nil
 }
 
+// filter passes the xFilter arguments vals, and fargs, to the cursor.
+func (vtc *sqliteVTabCursor) filter(idxNum int, idxStr string, vals []any, fargs []FilterArg) error {
+	switch f := vtc.vTabCursor.(type) {
+	case VTabCursorArgFilterContext:
+		vtc.filterArgs(vals, fargs)
+		return f.FilterArgsContext(vtc.vTab.module.c.stepContext(), idxNum, idxStr, fargs)
+	case VTabCursorArgFilter:
+		vtc.filterArgs(vals, fargs)
+		return f.FilterArgs(idxNum, idxStr, fargs)
+	case VTabCursorContext:
+		return f.FilterContext(vtc.vTab.module.c.stepContext(), idxNum, idxStr, vals)
+	default:
+		return vtc.vTabCursor.Filter(idxNum, idxStr, vals)
+	}
+}
+
+// filterArgSize is the size of an entry of the argument map goVBestIndex
+// stores after idxStr: one byte for the operator and four for the column.
+const filterArgSize = 5
+
+// filterArgs returns the column and operator of each of the argc xFilter
+// arguments, as recorded by goVBestIndex after the NUL terminator of idxStr.
+func filterArgs(idxStr *C.char, idxStrLen, argc int) []FilterArg {
+	if argc == 0 {
+		return nil
+	}
+	argMap := C.GoBytes(unsafe.Add(unsafe.Pointer(idxStr), idxStrLen+1), C.int(argc*filterArgSize))
+	args := make([]FilterArg, argc)
+	for i := range args {
+		entry := argMap[i*filterArgSize:]
+		args[i].Op = Op(entry[0])
+		args[i].Column = int(int32(binary.LittleEndian.Uint32(entry[1:])))
+	}
+	return args
+}
+
+// filterArgValue converts a flat Filter value to the value of arg:
+// NULL is reported as nil, and comparison operands are coerced to the
+// affinity of their column when the VTab declares it.
+func filterArgValue(v any, arg FilterArg, aff VTabColumnAffinity) any {
+	if z, ok := v.([]byte); ok && z == nil {
+		return nil
+	}
+	if aff == nil || arg.Column < 0 {
+		return v
+	}
+	switch arg.Op {
+	case OpEQ, OpGT, OpLE, OpLT, OpGE, OpNE, OpIS, OpISNOT:
+	default:
+		return v
+	}
+	a := aff.ColumnAffinity(arg.Column)
+	if in, ok := v.([]any); ok {
+		for i := range in {
+			in[i] = a.Apply(in[i])
+		}
+		return in
+	}
+	return a.Apply(v)
+}
+
 //export goVNext
-func goVNext(pCursor unsafe.Pointer) *C.char {
+func goVNext(pCursor unsafe.Pointer) (pzErr *C.char) {
+	defer vtabRecover(pCursor, &pzErr)
 	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
-	err := vtc.vTabCursor.Next()
+	if vtc.eofErr != nil {
+		return mPrintf("%s", vtc.eofErr.Error())
+	}
+	var err error
+	if vtc.vTab.module.intercepted() {
+		err = vtc.vTab.intercept(&VTabCall{Method: "Next"}, vtc.next)
+	} else {
+		err = vtc.next()
+	}
 	if err != nil {
 		return mPrintf("%s", err.Error())
 	}
 	return nil
 }
 
+// filterArgs sets the values of fargs from the xFilter arguments vals.
+func (vtc *sqliteVTabCursor) filterArgs(vals []any, fargs []FilterArg) {
+	aff, _ := vtc.vTab.vTab.(VTabColumnAffinity)
+	for i := range fargs {
+		fargs[i].Value = filterArgValue(vals[i], fargs[i], aff)
+	}
+}
+
+// next advances the cursor.
+func (vtc *sqliteVTabCursor) next() error {
+	if n, ok := vtc.vTabCursor.(VTabCursorContext); ok {
+		return n.NextContext(vtc.vTab.module.c.stepContext())
+	}
+	return vtc.vTabCursor.Next()
+}
+
+//export goVNextBatch
+func goVNextBatch(pCursor unsafe.Pointer, pCells **C.goVCell, nRow, nCol *C.int) (pzErr *C.char) {
+	defer vtabRecover(pCursor, &pzErr)
+	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
+	var rows [][]any
+	var err error
+	if vtc.vTab.module.intercepted() {
+		rows, err = vtc.interceptNextBatch()
+	} else {
+		rows, err = vtc.vTabCursor.(VTabCursorBatch).NextBatch()
+	}
+	if err != nil {
+		return mPrintf("%s", err.Error())
+	}
+	vtc.rows += int64(len(rows))
+	cells, cols, err := newBatch(rows)
+	if err != nil {
+		return mPrintf("%s", err.Error())
+	}
+	*pCells, *nRow, *nCol = cells, C.int(len(rows)), C.int(cols)
+	return nil
+}
+
+// interceptNextBatch returns the next batch of the cursor through the
+// interceptors of its table.
+func (vtc *sqliteVTabCursor) interceptNextBatch() (rows [][]any, err error) {
+	call := &VTabCall{Method: "NextBatch"}
+	err = vtc.vTab.intercept(call, func() (err error) {
+		rows, err = vtc.vTabCursor.(VTabCursorBatch).NextBatch()
+		call.Rows = int64(len(rows))
+		return err
+	})
+	return rows, err
+}
+
+// newBatch copies rows into a single sqlite3_malloc'ed block holding the
+// cells of the rows followed by the bytes of their TEXT and BLOB values.
+func newBatch(rows [][]any) (*C.goVCell, int, error) {
+	var cols, size int
+	for _, row := range rows {
+		cols = max(cols, len(row))
+		for _, v := range row {
+			switch x := v.(type) {
+			case string:
+				size += len(x)
+			case []byte:
+				size += len(x)
+			}
+		}
+	}
+	n := len(rows) * cols
+	if n == 0 {
+		return nil, cols, nil
+	}
+	cellsSize := n * int(unsafe.Sizeof(C.goVCell{}))
+	p := C.sqlite3_malloc64(C.sqlite3_uint64(cellsSize + size))
+	if p == nil {
+		return nil, 0, ErrNomem
+	}
+	cells := unsafe.Slice((*C.goVCell)(p), n)
+	data := unsafe.Slice((*byte)(unsafe.Add(p, cellsSize)), size)
+	for i, row := range rows {
+		for j := 0; j < cols; j++ {
+			cell := &cells[i*cols+j]
+			*cell = C.goVCell{_type: C.SQLITE_NULL}
+			if j >= len(row) {
+				continue
+			}
+			switch x := row[j].(type) {
+			case nil:
+			case int64:
+				cell._type, cell.i = C.SQLITE_INTEGER, C.sqlite3_int64(x)
+			case int:
+				cell._type, cell.i = C.SQLITE_INTEGER, C.sqlite3_int64(x)
+			case int32:
+				cell._type, cell.i = C.SQLITE_INTEGER, C.sqlite3_int64(x)
+			case bool:
+				cell._type = C.SQLITE_INTEGER
+				if x {
+					cell.i = 1
+				}
+			case float64:
+				cell._type, cell.d = C.SQLITE_FLOAT, C.double(x)
+			case float32:
+				cell._type, cell.d = C.SQLITE_FLOAT, C.double(x)
+			case string:
+				cell._type, cell.n = C.SQLITE_TEXT, C.int(len(x))
+				cell.p = (*C.char)(unsafe.Pointer(unsafe.SliceData(data)))
+				data = data[copy(data, x):]
+			case []byte:
+				if x == nil {
+					continue
+				}
+				cell._type, cell.n = C.SQLITE_BLOB, C.int(len(x))
+				cell.p = (*C.char)(unsafe.Pointer(unsafe.SliceData(data)))
+				data = data[copy(data, x):]
+			default:
+				C.sqlite3_free(p)
+				return nil, 0, fmt.Errorf("unsupported type %T in row %d, column %d", x, i, j)
+			}
+		}
+	}
+	return (*C.goVCell)(p), cols, nil
+}
+
 //export goVEof
-func goVEof(pCursor unsafe.Pointer) C.int {
+func goVEof(pCursor unsafe.Pointer) (eof C.int) {
 	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
-	err := vtc.vTabCursor.EOF()
-	if err {
+	defer func() {
+		if r := recover(); r != nil {
+			// xEof cannot fail, report the panic with the next call
+			// rather than truncating the results
+			vtc.eofErr = newPanicError(lookupHandleVal(pCursor).db, r)
+			eof = 0
+		}
+	}()
+	if vtc.vTabCursor.EOF() {
 		return 1
 	}
+	vtc.rows++
 	return 0
 }
 
 //export goVColumn
-func goVColumn(pCursor, cp unsafe.Pointer, col C.int, nochange C.int) *C.char {
+func goVColumn(pCursor, cp unsafe.Pointer, col C.int, nochange C.int) (pzErr *C.char) {
+	defer vtabRecover(pCursor, &pzErr)
 	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
+	if vtc.eofErr != nil {
+		return mPrintf("%s", vtc.eofErr.Error())
+	}
 	c := (*SQLiteContext)(cp)
 	// When no change is set, it means we are in an update
 	// and the column will not change.
@@ -681,9 +1484,17 @@ func goVColumn(pCursor, cp unsafe.Pointer, col C.int, nochange C.int) *C.char {
 }
 
 //export goVRowid
-func goVRowid(pCursor unsafe.Pointer, pRowid *C.sqlite3_int64) *C.char {
+func goVRowid(pCursor unsafe.Pointer, pRowid *C.sqlite3_int64) (pzErr *C.char) {
+	defer vtabRecover(pCursor, &pzErr)
 	vtc := lookupHandle(pCursor).(*sqliteVTabCursor)
-	rowid, err := vtc.vTabCursor.Rowid()
+	if vtc.eofErr != nil {
+		return mPrintf("%s", vtc.eofErr.Error())
+	}
+	c, ok := vtc.vTabCursor.(VTabCursorRowid)
+	if !ok {
+		return mPrintf("%s", "sqlite3: virtual table cursor does not implement Rowid")
+	}
+	rowid, err := c.Rowid()
 	if err != nil {
 		return mPrintf("%s", err.Error())
 	}
@@ -692,9 +1503,27 @@ func goVRowid(pCursor unsafe.Pointer, pRowid *C.sqlite3_int64) *C.char {
 }
 
 //export goVUpdate
-func goVUpdate(pVTab unsafe.Pointer, argc C.int, argv **C.sqlite3_value, pRowid *C.sqlite3_int64) *C.char {
+func goVUpdate(pVTab unsafe.Pointer, argc C.int, argv **C.sqlite3_value, pRowid *C.sqlite3_int64, rc *C.int) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
 	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if err := vt.checkSchema(); err != nil {
+		return mPrintf("%s", err.Error())
+	}
+	err := vt.intercept(&VTabCall{Method: "Update"}, func() error {
+		return vt.update(argc, argv, pRowid)
+	})
+	if err != nil {
+		if isConstraintError(err) {
+			*rc = C.SQLITE_CONSTRAINT
+		}
+		return mPrintf("%s", err.Error())
+	}
+	return nil
+}
 
+// update passes the xUpdate arguments to the VTabUpdater or
+// VTabRequestUpdater vt.
+func (vt *sqliteVTab) update(argc C.int, argv **C.sqlite3_value, pRowid *C.sqlite3_int64) error {
 	var tname string
 	if n, ok := vt.vTab.(interface {
 		TableName() string
@@ -703,14 +1532,17 @@ func goVUpdate(pVTab unsafe.Pointer, argc C.int, argv **C.sqlite3_value, pRowid
 	}
 
 	err := fmt.Errorf("virtual %s table %sis read-only", vt.module.name, tname)
-	if v, ok := vt.vTab.(VTabUpdater); ok {
+	if v, ok := vt.vTab.(VTabRequestUpdater); ok {
+		args := (*[(math.MaxInt32 - 1) / unsafe.Sizeof((*C.sqlite3_value)(nil))]*C.sqlite3_value)(unsafe.Pointer(argv))[:argc:argc]
+		err = applyUpdateRequest(vt.module.c, v, args, pRowid)
+	} else if v, ok := vt.vTab.(VTabUpdater); ok {
 		// convert argv
 		args := (*[(math.MaxInt32 - 1) / unsafe.Sizeof((*C.sqlite3_value)(nil))]*C.sqlite3_value)(unsafe.Pointer(argv))[:argc:argc]
 		vals := make([]any, 0, argc)
 		for _, v := range args {
 			conv, err := callbackArgGeneric(v)
 			if err != nil {
-				return mPrintf("%s", err.Error())
+				return err
 			}
 
 			// work around for SQLITE_NULL
@@ -751,19 +1583,69 @@ func goVUpdate(pVTab unsafe.Pointer, argc C.int, argv **C.sqlite3_value, pRowid
 	} else {
 		err = fmt.Errorf("virtual %s table %sis not updatable", vt.module.name, tname)
 	}
+	return err
+}
 
-	if err != nil {
-		return mPrintf("%s", err.Error())
+// applyUpdateRequest passes the xUpdate arguments args to v as an
+// UpdateRequest.
+func applyUpdateRequest(c *SQLiteConn, v VTabRequestUpdater, args []*C.sqlite3_value, pRowid *C.sqlite3_int64) error {
+	vals := make([]any, len(args))
+	for i, arg := range args {
+		var err error
+		vals[i], err = valueToGo(arg)
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	req := &UpdateRequest{OnConflict: c.VTabOnConflict()}
+	switch {
+	case len(args) == 1:
+		req.Kind = DeleteRow
+		req.OldRowid = vals[0]
+	case C.sqlite3_value_type(args[0]) == C.SQLITE_NULL:
+		req.Kind = InsertRow
+		req.NewRowid = vals[1]
+		req.Values = vals[2:]
+		req.Changed = make([]bool, len(req.Values))
+		for i := range req.Changed {
+			req.Changed[i] = true
+		}
+	default:
+		req.Kind = UpdateRow
+		req.OldRowid = vals[0]
+		req.NewRowid = vals[1]
+		req.Values = vals[2:]
+		req.Changed = make([]bool, len(req.Values))
+		for i, arg := range args[2:] {
+			req.Changed[i] = C.sqlite3_value_nochange(arg) == 0
+		}
+	}
+
+	rowid, err := v.ApplyUpdate(req)
+	if err == nil && req.Kind == InsertRow {
+		*pRowid = C.sqlite3_int64(rowid)
+	}
+	return err
+}
+
+// isConstraintError reports whether err is, or wraps, ErrConstraint.
+func isConstraintError(err error) bool {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Code == ErrConstraint
+	}
+	return errors.Is(err, ErrConstraint)
 }
 
 //export goVBegin
-func goVBegin(pVTab unsafe.Pointer) *C.char {
+func goVBegin(pVTab unsafe.Pointer) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
 	vt := lookupHandle(pVTab).(*sqliteVTab)
 	if v, ok := vt.vTab.(VTabTransaction); ok {
-		err := v.Begin()
+		err := vt.intercept(&VTabCall{Method: "Begin"}, func() error {
+			return v.Begin()
+		})
 		if err != nil {
 			return mPrintf("%s", err.Error())
 		}
@@ -772,10 +1654,13 @@ func goVBegin(pVTab unsafe.Pointer) *C.char {
 }
 
 //export goVCommit
-func goVCommit(pVTab unsafe.Pointer) *C.char {
+func goVCommit(pVTab unsafe.Pointer) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
 	vt := lookupHandle(pVTab).(*sqliteVTab)
 	if v, ok := vt.vTab.(VTabTransaction); ok {
-		err := v.Commit()
+		err := vt.intercept(&VTabCall{Method: "Commit"}, func() error {
+			return v.Commit()
+		})
 		if err != nil {
 			return mPrintf("%s", err.Error())
 		}
@@ -784,10 +1669,153 @@ func goVCommit(pVTab unsafe.Pointer) *C.char {
 }
 
 //export goVRollback
-func goVRollback(pVTab unsafe.Pointer) *C.char {
+func goVRollback(pVTab unsafe.Pointer) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
 	vt := lookupHandle(pVTab).(*sqliteVTab)
 	if v, ok := vt.vTab.(VTabTransaction); ok {
-		err := v.Rollback()
+		err := vt.intercept(&VTabCall{Method: "Rollback"}, func() error {
+			return v.Rollback()
+		})
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+//export goVFindFunction
+func goVFindFunction(pVTab unsafe.Pointer, nArg C.int, zName *C.char, ppArg *unsafe.Pointer) (rc C.int) {
+	defer func() {
+		if r := recover(); r != nil {
+			// xFindFunction cannot fail, do not overload the function
+			newPanicError(lookupHandleVal(pVTab).db, r)
+			rc = 0
+		}
+	}()
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	v, ok := vt.vTab.(VTabFunctionOverloader)
+	if !ok {
+		return 0
+	}
+	name := C.GoString(zName)
+	impl, op := v.FindFunction(int(nArg), name)
+	if impl == nil {
+		return 0
+	}
+	key := fmt.Sprintf("%d/%s", nArg, name)
+	handle, ok := vt.funcs[key]
+	if !ok {
+		fi, _, err := newFunctionInfo(impl)
+		if err != nil {
+			return 0
+		}
+		c := vt.module.c
+		// fi must outlast the database connection, as for RegisterFunc
+		c.funcs = append(c.funcs, fi)
+		handle = newHandle(c, fi)
+		if vt.funcs == nil {
+			vt.funcs = make(map[string]unsafe.Pointer)
+		}
+		vt.funcs[key] = handle
+	}
+	*ppArg = handle
+	if op >= OpFUNCTION {
+		return C.int(op)
+	}
+	return 1
+}
+
+// goVFunction calls a function returned by VTabFunctionOverloader.
+//
+//export goVFunction
+func goVFunction(ctx *C.sqlite3_context, argc C.int, argv **C.sqlite3_value) {
+	callbackTrampoline(ctx, int(argc), argv)
+}
+
+//export goVRename
+func goVRename(pVTab unsafe.Pointer, zNew *C.char) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if v, ok := vt.vTab.(VTabRenamer); ok {
+		err := vt.intercept(&VTabCall{Method: "Rename"}, func() error {
+			return v.Rename(C.GoString(zNew))
+		})
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+//export goVIntegrity
+func goVIntegrity(pVTab unsafe.Pointer, zSchema, zTabName *C.char, mFlags C.int, pzErr **C.char) (zErr *C.char) {
+	defer vtabRecover(pVTab, &zErr)
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if v, ok := vt.vTab.(VTabIntegrity); ok {
+		problems, err := v.Integrity(C.GoString(zSchema), C.GoString(zTabName), mFlags&1 != 0)
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+		if len(problems) > 0 {
+			*pzErr = mPrintf("%s", strings.Join(problems, "\n"))
+		}
+	}
+	return nil
+}
+
+//export goVSync
+func goVSync(pVTab unsafe.Pointer) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if v, ok := vt.vTab.(VTabSync); ok {
+		err := vt.intercept(&VTabCall{Method: "Sync"}, func() error {
+			return v.Sync()
+		})
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+//export goVSavepoint
+func goVSavepoint(pVTab unsafe.Pointer, n C.int) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if v, ok := vt.vTab.(VTabSavepoint); ok {
+		err := vt.intercept(&VTabCall{Method: "Savepoint"}, func() error {
+			return v.Savepoint(int(n))
+		})
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+//export goVReleaseSavepoint
+func goVReleaseSavepoint(pVTab unsafe.Pointer, n C.int) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if v, ok := vt.vTab.(VTabSavepoint); ok {
+		err := vt.intercept(&VTabCall{Method: "Release"}, func() error {
+			return v.Release(int(n))
+		})
+		if err != nil {
+			return mPrintf("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+//export goVRollbackTo
+func goVRollbackTo(pVTab unsafe.Pointer, n C.int) (pzErr *C.char) {
+	defer vtabRecover(pVTab, &pzErr)
+	vt := lookupHandle(pVTab).(*sqliteVTab)
+	if v, ok := vt.vTab.(VTabSavepoint); ok {
+		err := vt.intercept(&VTabCall{Method: "RollbackTo"}, func() error {
+			return v.RollbackTo(int(n))
+		})
 		if err != nil {
 			return mPrintf("%s", err.Error())
 		}
@@ -827,8 +1855,253 @@ type VTabTransaction interface {
 	Rollback() error
 }
 
+// VTabFunctionOverloader is a VTab that overloads SQL functions whose
+// first argument is one of its columns.
+//
+// FindFunction returns the implementation of the function name called
+// with nArg arguments, as accepted by SQLiteConn.RegisterFunc, or nil to
+// keep the default implementation. name is as written in the statement,
+// so it should be compared case-insensitively. If op is OpFUNCTION or
+// above, a call with two arguments in the WHERE clause, such as
+// match(col, 'foo'), is also passed to BestIndex as a constraint on col
+// with operator op, so that it can be pushed down.
+//
+// SQLite only looks for overloads of calls whose argument is a plain
+// column reference, so calls within aggregates are not overloaded.
+//
+// Only functions that already exist can be overloaded: placeholders can
+// be registered with SQLiteConn.OverloadFunction.
+// See: https://sqlite.org/vtab.html#xfindfunction
+type VTabFunctionOverloader interface {
+	VTab
+	FindFunction(nArg int, name string) (impl any, op Op)
+}
+
+// VTabConfigOption is a virtual table configuration option, set with
+// SQLiteConn.VTabConfig.
+type VTabConfigOption int
+
+// Virtual table configuration options.
+// See: https://sqlite.org/c3ref/c_vtab_constraint_support.html
+const (
+	// VTabConstraintSupport tells SQLite that the Insert, Update and
+	// Delete methods of the table handle ON CONFLICT clauses: when they
+	// return ErrConstraint, the statement fails or skips the row
+	// according to SQLiteConn.VTabOnConflict, instead of failing with an
+	// error. Changes made before returning ErrConstraint must be undone
+	// by the table.
+	VTabConstraintSupport VTabConfigOption = 1
+	// VTabInnocuous marks the table as safe to use from triggers, views
+	// and schema structures even when trusted_schema is off.
+	VTabInnocuous VTabConfigOption = 2
+	// VTabDirectOnly prevents the table from being used from triggers
+	// and views.
+	VTabDirectOnly VTabConfigOption = 3
+	// VTabUsesAllSchemas tells that the table uses the content of all the
+	// attached databases. It requires SQLite 3.46.0 or later.
+	VTabUsesAllSchemas VTabConfigOption = 4
+)
+
+// VTabConfig sets an option of the virtual table being created or
+// connected. It must be called from Module.Create or Module.Connect.
+// See: https://sqlite.org/c3ref/vtab_config.html
+func (c *SQLiteConn) VTabConfig(opt VTabConfigOption) error {
+	rv := C._sqlite3_vtab_config(c.db, C.int(opt))
+	if rv != C.SQLITE_OK {
+		return Error{Code: ErrNo(rv)}
+	}
+	return nil
+}
+
+// ConflictMode is the ON CONFLICT mode of a statement.
+type ConflictMode int
+
+// Conflict modes, see SQLiteConn.VTabOnConflict.
+const (
+	ConflictRollback ConflictMode = C.SQLITE_ROLLBACK
+	ConflictIgnore   ConflictMode = C.SQLITE_IGNORE
+	ConflictFail     ConflictMode = C.SQLITE_FAIL
+	ConflictAbort    ConflictMode = C.SQLITE_ABORT
+	ConflictReplace  ConflictMode = C.SQLITE_REPLACE
+)
+
+// String returns the name of the mode, as in an ON CONFLICT clause.
+func (m ConflictMode) String() string {
+	switch m {
+	case ConflictRollback:
+		return "ROLLBACK"
+	case ConflictIgnore:
+		return "IGNORE"
+	case ConflictFail:
+		return "FAIL"
+	case ConflictAbort:
+		return "ABORT"
+	case ConflictReplace:
+		return "REPLACE"
+	}
+	return fmt.Sprintf("ConflictMode(%d)", int(m))
+}
+
+// VTabOnConflict returns the ON CONFLICT mode of the statement being run,
+// e.g. ConflictReplace for INSERT OR REPLACE, and ConflictAbort when the
+// statement has none. It must be called from the Insert, Update or
+// Delete method of a VTabUpdater, and is meant for tables configured with
+// VTabConstraintSupport.
+// See: https://sqlite.org/c3ref/vtab_on_conflict.html
+func (c *SQLiteConn) VTabOnConflict() ConflictMode {
+	return ConflictMode(C.sqlite3_vtab_on_conflict(c.db))
+}
+
+// InvalidateVTabSchemas invalidates the schemas declared by the virtual
+// tables of the module named module, e.g. when an upstream API gained
+// columns: each table is disconnected, and connected again by the next
+// statement using it, so that Module.Connect can declare its new schema.
+// SQLite cannot do this for some tables only: the tables of the other
+// modules are connected again too, but keep working as before.
+//
+// Statements prepared on the connection before the call fail with
+// ErrSchema once they use a table of the module, and must be prepared
+// again. The other statements are prepared again by SQLite.
+//
+// It cannot be called while a statement is running, e.g. from a VTab
+// method, nor once an eponymous table of the module has been used, as
+// SQLite only disconnects them when the connection is closed.
+func (c *SQLiteConn) InvalidateVTabSchemas(module string) error {
+	var m *sqliteModule
+	i := &c.vtabs.interceptors
+	i.mu.Lock()
+	for _, r := range i.registered {
+		if strings.EqualFold(r.name, module) {
+			m = r
+		}
+	}
+	i.mu.Unlock()
+	if m == nil {
+		return fmt.Errorf("sqlite3: no virtual table module named %s", module)
+	}
+	if m.eponymous > 0 {
+		return fmt.Errorf("sqlite3: cannot invalidate the schemas of the eponymous virtual tables of %s", m.name)
+	}
+	for s := C.sqlite3_next_stmt(c.db, nil); s != nil; s = C.sqlite3_next_stmt(c.db, s) {
+		if C.sqlite3_stmt_busy(s) != 0 {
+			return errors.New("sqlite3: cannot invalidate virtual table schemas while a statement is running")
+		}
+	}
+	// SQLite reloads all the schemas, and reconnects their virtual tables,
+	// when a savepoint that changed a schema is rolled back. Changing the
+	// temp schema leaves the database files untouched.
+	ctx := context.Background()
+	if _, err := c.exec(ctx, "SAVEPOINT go_sqlite3_invalidate", nil); err != nil {
+		return err
+	}
+	_, err := c.exec(ctx, "CREATE TEMP TABLE go_sqlite3_invalidate(x)", nil)
+	_, rerr := c.exec(ctx, "ROLLBACK TO go_sqlite3_invalidate; RELEASE go_sqlite3_invalidate", nil)
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return err
+	}
+	c.vtabs.gen++
+	m.invalidated = c.vtabs.gen
+	return nil
+}
+
+// VTabIntegrity is a VTab that checks its own integrity when running
+// PRAGMA integrity_check and PRAGMA quick_check, which report problems
+// along with the ones of the database. quick tells that the check should
+// be fast, for quick_check. An error aborts the check altogether.
+//
+// It requires SQLite 3.44.0 or later, and is ignored otherwise.
+// See: https://sqlite.org/vtab.html#xintegrity
+type VTabIntegrity interface {
+	VTab
+	Integrity(schema, table string, quick bool) (problems []string, err error)
+}
+
+// VTabRenamer is a VTab that is notified of ALTER TABLE RENAME, e.g. to
+// update its own metadata. An error aborts the rename.
+// See: https://sqlite.org/vtab.html#xrename
+type VTabRenamer interface {
+	VTab
+	Rename(newName string) error
+}
+
+// OverloadFunction makes sure that a function named name with nArg
+// arguments exists, so that it can be overloaded by virtual tables. The
+// placeholder function fails when it is called with no overload.
+// See: https://sqlite.org/c3ref/overload_function.html
+func (c *SQLiteConn) OverloadFunction(name string, nArg int) error {
+	zName := C.CString(name)
+	defer C.free(unsafe.Pointer(zName))
+	rv := C.sqlite3_overload_function(c.db, zName, C.int(nArg))
+	if rv != C.SQLITE_OK {
+		return c.lastError()
+	}
+	return nil
+}
+
+// VTabSync is a VTabTransaction with a first commit phase. It is only used
+// by modules implementing TransactionModule.
+//
+// Sync is called on every virtual table of a transaction before any of
+// them, or the database, commits. An error fails the commit and rolls
+// back the whole transaction, so Sync is the place to validate or stage
+// writes to an external system; Commit should not fail afterwards.
+// See: https://sqlite.org/vtab.html#xsync
+type VTabSync interface {
+	VTabTransaction
+	Sync() error
+}
+
+// VTabSavepoint is a VTabTransaction that supports savepoints. It is only
+// used by modules implementing TransactionModule.
+//
+// Savepoint marks the current state as savepoint n, Release discards the
+// savepoints n and above, and RollbackTo restores the state of savepoint
+// n, which stays open. Savepoints are numbered from 0 within a
+// transaction, and SQLite calls Savepoint with the current level when a
+// table joins a transaction in which savepoints are already open.
+// See: https://sqlite.org/vtab.html#xsavepoint
+type VTabSavepoint interface {
+	VTabTransaction
+	Savepoint(n int) error
+	Release(n int) error
+	RollbackTo(n int) error
+}
+
+// IndexInformation gives additional information about the statement
+// being planned in BestIndex.
 type IndexInformation struct {
+	// ColUsed is the bitmask of the columns used by the statement, whose
+	// last bit stands for all the columns from index 63 onwards.
+	// See ColumnUsed.
 	ColUsed uint64
+	// Distinct tells how the statement uses the rows returned by the
+	// virtual table: 0 means all rows are needed in order, 1 means only
+	// rows with distinct ORDER BY values are needed, 2 means only
+	// distinct rows are needed, and 3 means distinct rows are needed
+	// but their order does not matter.
+	// See: https://sqlite.org/c3ref/vtab_distinct.html
+	Distinct int
+}
+
+// ColumnUsed reports whether the column at index col may be used by the
+// statement.
+//
+// It is only exact for the first 63 columns. For the columns from index
+// 63 onwards, it reports whether any of them is used, as colUsed has a
+// single bit for all of them: a table wider than 63 columns cannot know
+// exactly which of its last columns are needed, as SQLite does not
+// provide that information.
+func (info IndexInformation) ColumnUsed(col int) bool {
+	if col < 0 {
+		return false
+	}
+	if col > 63 {
+		col = 63
+	}
+	return info.ColUsed&(1<<uint(col)) != 0
 }
 
 // VTab describes a particular instance of the virtual table.
@@ -845,7 +2118,12 @@ type VTab interface {
 }
 
 // VTabUpdater is a type that allows a VTab to be inserted, updated, or
-// deleted.
+// deleted. Methods returning ErrConstraint, or an error wrapping it, fail
+// with SQLITE_CONSTRAINT, see VTabConstraintSupport.
+//
+// The keys passed to Delete and Update are rowids, or the PRIMARY KEY
+// values of WITHOUT ROWID tables, for which the rowid returned by Insert
+// is ignored.
 // See: https://sqlite.org/vtab.html#xupdate
 type VTabUpdater interface {
 	VTab
@@ -855,6 +2133,129 @@ type VTabUpdater interface {
 	PartialUpdate() bool
 }
 
+// UpdateKind is the kind of change of an UpdateRequest.
+type UpdateKind int
+
+// Kinds of UpdateRequest.
+const (
+	InsertRow UpdateKind = iota
+	UpdateRow
+	DeleteRow
+)
+
+// UpdateRequest is a change to a row of a VTabRequestUpdater.
+type UpdateRequest struct {
+	Kind UpdateKind
+	// OldRowid is the rowid of the updated or deleted row, nil for
+	// inserts. For WITHOUT ROWID tables, it is the PRIMARY KEY value.
+	OldRowid any
+	// NewRowid is the rowid of the inserted or updated row, nil for
+	// deletes. It is also nil for inserts that leave the choice of the
+	// rowid to the table. It differs from OldRowid when an update
+	// changes the rowid. For WITHOUT ROWID tables, it is the new
+	// PRIMARY KEY value of updates, and nil for inserts.
+	NewRowid any
+	// Values are the new values of the columns, nil for deletes. The
+	// values of the columns not changed by an update are nil.
+	Values []any
+	// Changed tells which columns are set by the statement: all of them
+	// for inserts, and the ones of the SET clause for updates.
+	Changed []bool
+	// OnConflict is the ON CONFLICT mode of the statement, see
+	// SQLiteConn.VTabOnConflict.
+	OnConflict ConflictMode
+}
+
+// VTabRequestUpdater is a VTab that can be inserted, updated or deleted
+// through UpdateRequest, which unlike VTabUpdater tells unchanged
+// columns apart from columns set to NULL. It takes precedence over
+// VTabUpdater, and its cursors are never asked for the values of
+// unchanged columns, as with VTabUpdater.PartialUpdate.
+//
+// ApplyUpdate returns the rowid of inserted rows, which is ignored for
+// WITHOUT ROWID tables. Returning ErrConstraint
+// fails with SQLITE_CONSTRAINT, see VTabConstraintSupport.
+// See: https://sqlite.org/vtab.html#xupdate
+type VTabRequestUpdater interface {
+	VTab
+	ApplyUpdate(req *UpdateRequest) (rowid int64, err error)
+}
+
+// FilterArg is a Filter argument along with the constraint it belongs to.
+type FilterArg struct {
+	// Column is the index of the constrained column, -1 for the rowid.
+	// It is meaningless for OpLIMIT and OpOFFSET.
+	Column int
+	Op     Op
+	// Value is the right-hand side of the constraint: nil for NULL and
+	// unary operators, []any for IN lists processed all at once.
+	Value any
+}
+
+// VTabCursorArgFilter is a VTabCursor that receives structured arguments.
+// If a cursor implements it, FilterArgs is called instead of Filter, with
+// the arguments in the order of the constraints used by BestIndex, or
+// the one set by IndexResult.ArgvIndex.
+type VTabCursorArgFilter interface {
+	VTabCursor
+	FilterArgs(idxNum int, idxStr string, args []FilterArg) error
+}
+
+// VTabCursorArgFilterContext is a VTabCursor that receives structured
+// arguments along with the context of the statement being run, as
+// VTabCursorContext.FilterContext does. If a cursor implements it,
+// FilterArgsContext is called instead of FilterArgs and FilterContext.
+type VTabCursorArgFilterContext interface {
+	VTabCursor
+	FilterArgsContext(ctx context.Context, idxNum int, idxStr string, args []FilterArg) error
+}
+
+// VTabColumnAffinity is a VTab that declares the affinity of its columns.
+// The FilterArg values of comparison constraints are then coerced to the
+// affinity of their column, as SQLite would do for a regular table.
+type VTabColumnAffinity interface {
+	VTab
+	ColumnAffinity(col int) Affinity
+}
+
+// VTabCursorBatch is a VTabCursor that produces its rows in batches,
+// which SQLite then iterates without calling back into Go for every row
+// and column. After Filter, NextBatch is called until it returns no rows;
+// Next, EOF, Column and Rowid are never called, and the rowid of a row is
+// its position in the scan. Because of that, writable tables, i.e. VTabs
+// implementing VTabUpdater or VTabRequestUpdater, cannot open batch
+// cursors: UPDATE and DELETE would modify the wrong rows.
+//
+// Values of a row must be nil, int, int32, int64, bool, float32, float64,
+// string or []byte.
+type VTabCursorBatch interface {
+	VTabCursor
+	NextBatch() ([][]any, error)
+}
+
+// VTabCursorContext is a VTabCursor whose Filter and Next receive the
+// context of the statement being run, so that slow upstream calls can be
+// aborted when the statement is cancelled or interrupted.
+// If a cursor implements it, FilterContext and NextContext are called
+// instead of Filter and Next. FilterArgs takes precedence over
+// FilterContext, cursors receiving structured arguments get the context
+// with VTabCursorArgFilterContext.
+type VTabCursorContext interface {
+	VTabCursor
+	FilterContext(ctx context.Context, idxNum int, idxStr string, vals []any) error
+	NextContext(ctx context.Context) error
+}
+
+// VTabContext returns the context of the statement currently run by the
+// connection, or context.Background() outside of a statement. It is
+// meant for virtual table callbacks that have no context argument, such
+// as VTabCursorArgFilter.FilterArgs or VTabCursorBatch.NextBatch. It
+// stays valid across the steps of the statement, and is cancelled once
+// its rows are closed or its execution completes.
+func (c *SQLiteConn) VTabContext() context.Context {
+	return c.stepContext()
+}
+
 // VTabCursor describes cursors that point into the virtual table and are used
 // to loop through the virtual table. See: http://sqlite.org/c3ref/vtab_cursor.html
 type VTabCursor interface {
@@ -868,6 +2269,18 @@ type VTabCursor interface {
 	EOF() bool
 	// http://sqlite.org/vtab.html#xcolumn
 	Column(c *SQLiteContext, col int) error
+}
+
+// VTabCursorRowid is a VTabCursor returning the rowids of its rows, which
+// all cursors must implement but those of WITHOUT ROWID tables, which
+// SQLite never asks for rowids, and those implementing VTabCursorBatch.
+//
+// The PRIMARY KEY of a WITHOUT ROWID table must be a single column,
+// whose values are passed to VTabUpdater and VTabRequestUpdater in place
+// of rowids: DeclareVTab fails otherwise, even for read-only tables.
+// See: https://sqlite.org/vtab.html#_without_rowid_virtual_tables_
+type VTabCursorRowid interface {
+	VTabCursor
 	// http://sqlite.org/vtab.html#xrowid
 	Rowid() (int64, error)
 }
@@ -877,39 +2290,128 @@ type VTabCursor interface {
 func (c *SQLiteConn) DeclareVTab(sql string) error {
 	zSQL := C.CString(sql)
 	defer C.free(unsafe.Pointer(zSQL))
-	rv := C.sqlite3_declare_vtab(c.db, zSQL)
+	rv := C._sqlite3_declare_vtab(c.db, zSQL)
 	if rv != C.SQLITE_OK {
-		return c.lastError()
+		if err := c.lastError(); err != nil {
+			return err
+		}
+		return Error{
+			Code:         ErrNo(rv),
+			ExtendedCode: ErrNoExtended(rv),
+			err:          "sqlite3: WITHOUT ROWID virtual table needs a single-column primary key",
+		}
 	}
 	return nil
 }
 
+// EponymousModule is a "virtual table module" (as above) whose tables
+// can be used both with CREATE VIRTUAL TABLE and as eponymous virtual
+// tables, named after the module. Create is then never called, since
+// both uses go through Connect.
+// See: https://sqlite.org/vtab.html#eponymous_virtual_tables
+type EponymousModule interface {
+	Module
+	EponymousModule()
+}
+
+// ShadowTableModule is a "virtual table module" (as above) whose tables
+// store their state in shadow tables, named after the virtual table,
+// followed by an underscore and one of the suffixes returned by
+// ShadowNames, e.g. "config" for "mytable_config".
+//
+// Shadow tables are read-only to ordinary statements when the connection
+// runs in defensive mode (SQLITE_DBCONFIG_DEFENSIVE). ShadowNames is
+// called once, by CreateModule.
+// See: https://sqlite.org/vtab.html#the_xshadowname_method
+type ShadowTableModule interface {
+	Module
+	ShadowNames() []string
+}
+
+// shadowNames are the shadow table names of the xShadowName functions
+// of the pool, see GO_SHADOW_NAME_SLOTS. Modules with the same names
+// share a function.
+var shadowNames struct {
+	sync.Mutex
+	slots [][]string
+}
+
+// shadowNameSlot returns the index of the xShadowName function that
+// accepts names.
+func shadowNameSlot(names []string) (int, error) {
+	names = append([]string{}, names...)
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+	sort.Strings(names)
+
+	shadowNames.Lock()
+	defer shadowNames.Unlock()
+	for i, slot := range shadowNames.slots {
+		if reflect.DeepEqual(slot, names) {
+			return i, nil
+		}
+	}
+	if len(shadowNames.slots) == C.GO_SHADOW_NAME_SLOTS {
+		return 0, fmt.Errorf("sqlite3: too many distinct sets of shadow table names, at most %d are supported", C.GO_SHADOW_NAME_SLOTS)
+	}
+	shadowNames.slots = append(shadowNames.slots, names)
+	return len(shadowNames.slots) - 1, nil
+}
+
+//export goMShadowName
+func goMShadowName(slot C.int, zName *C.char) C.int {
+	name := strings.ToLower(C.GoString(zName))
+	shadowNames.Lock()
+	defer shadowNames.Unlock()
+	for _, n := range shadowNames.slots[slot] {
+		if n == name {
+			return 1
+		}
+	}
+	return 0
+}
+
+// moduleCapabilities returns the optional callbacks of the sqlite3_module
+// of module, according to the interfaces it implements. They can be
+// combined, e.g. an EponymousOnlyModule can also be a TransactionModule.
+func moduleCapabilities(module Module) C.int {
+	var caps C.int
+	if _, ok := module.(EponymousOnlyModule); ok {
+		caps |= C.GO_MODULE_EPONYMOUS_ONLY
+	}
+	if _, ok := module.(EponymousModule); ok {
+		caps |= C.GO_MODULE_EPONYMOUS
+	}
+	if _, ok := module.(TransactionModule); ok {
+		caps |= C.GO_MODULE_TRANSACTION
+	}
+	return caps
+}
+
 // CreateModule registers a virtual table implementation.
 // See: http://sqlite.org/c3ref/create_module.html
 func (c *SQLiteConn) CreateModule(moduleName string, module Module) error {
 	mname := C.CString(moduleName)
 	defer C.free(unsafe.Pointer(mname))
-	udm := sqliteModule{c, moduleName, module}
-	switch module.(type) {
-	case TransactionModule:
-		rv := C._sqlite3_create_module_transaction(c.db, mname, C.uintptr_t(uintptr(newHandle(c, &udm))))
-		if rv != C.SQLITE_OK {
-			return c.lastError()
-		}
-		return nil
-
-	case EponymousOnlyModule:
-		rv := C._sqlite3_create_module_eponymous_only(c.db, mname, C.uintptr_t(uintptr(newHandle(c, &udm))))
-		if rv != C.SQLITE_OK {
-			return c.lastError()
-		}
-		return nil
-	case Module:
-		rv := C._sqlite3_create_module(c.db, mname, C.uintptr_t(uintptr(newHandle(c, &udm))))
-		if rv != C.SQLITE_OK {
-			return c.lastError()
+	shadowSlot := -1
+	if m, ok := module.(ShadowTableModule); ok {
+		var err error
+		shadowSlot, err = shadowNameSlot(m.ShadowNames())
+		if err != nil {
+			return err
 		}
-		return nil
+	}
+	pModule := C._sqlite3_new_module(moduleCapabilities(module), C.int(shadowSlot))
+	if pModule == nil {
+		return ErrNomem
+	}
+	udm := &sqliteModule{c: c, name: moduleName, module: module, pModule: pModule}
+	// goMDestroy unregisters the module, even if its creation fails
+	c.vtabs.interceptors.register(udm)
+	rv := C._sqlite3_create_module(c.db, mname, pModule, C.uintptr_t(uintptr(newHandle(c, udm))))
+	if rv != C.SQLITE_OK {
+		return c.lastError()
 	}
 	return nil
 }
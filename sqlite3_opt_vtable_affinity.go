@@ -0,0 +1,105 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build sqlite_vtable || vtable
+// +build sqlite_vtable vtable
+
+package sqlite3
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Affinity is the type affinity of a column.
+// See: https://sqlite.org/datatype3.html#type_affinity
+type Affinity int
+
+// Affinity mean type affinities of columns.
+const (
+	AffinityBlob Affinity = iota
+	AffinityText
+	AffinityNumeric
+	AffinityInteger
+	AffinityReal
+)
+
+// TypeAffinity returns the affinity of a column declared with the type
+// declType, following the rules SQLite uses for regular tables.
+// See: https://sqlite.org/datatype3.html#determination_of_column_affinity
+func TypeAffinity(declType string) Affinity {
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return AffinityInteger
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return AffinityText
+	case strings.Contains(t, "BLOB"), t == "":
+		return AffinityBlob
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return AffinityReal
+	default:
+		return AffinityNumeric
+	}
+}
+
+// Apply converts v, as returned by SQLite, the way SQLite would before
+// storing it in a column of affinity a. Values that cannot be converted
+// are returned unchanged.
+func (a Affinity) Apply(v any) any {
+	switch a {
+	case AffinityText:
+		switch x := v.(type) {
+		case int64:
+			return strconv.FormatInt(x, 10)
+		case float64:
+			return formatReal(x)
+		}
+	case AffinityNumeric, AffinityInteger:
+		switch x := v.(type) {
+		case string:
+			if n, ok := parseNumeric(x); ok {
+				return a.Apply(n)
+			}
+		case float64:
+			if x == math.Trunc(x) && x >= math.MinInt64 && x < math.MaxInt64 {
+				return int64(x)
+			}
+		}
+	case AffinityReal:
+		switch x := v.(type) {
+		case string:
+			if n, ok := parseNumeric(x); ok {
+				return a.Apply(n)
+			}
+		case int64:
+			return float64(x)
+		}
+	}
+	return v
+}
+
+// parseNumeric parses s as an INTEGER or REAL literal.
+func parseNumeric(s string) (any, bool) {
+	s = strings.TrimSpace(s)
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, false
+	}
+	return f, true
+}
+
+// formatReal renders f the way SQLite renders a REAL as TEXT.
+func formatReal(f float64) string {
+	s := strconv.FormatFloat(f, 'g', 15, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build sqlite_vtable || vtable
+// +build sqlite_vtable vtable
+
+package sqlite3
+
+import (
+	"testing"
+)
+
+func TestTypeAffinity(t *testing.T) {
+	tests := map[string]Affinity{
+		"INT":               AffinityInteger,
+		"BIGINT":            AffinityInteger,
+		"VARCHAR(255)":      AffinityText,
+		"text":              AffinityText,
+		"CLOB":              AffinityText,
+		"BLOB":              AffinityBlob,
+		"":                  AffinityBlob,
+		"REAL":              AffinityReal,
+		"DOUBLE PRECISION":  AffinityReal,
+		"FLOAT":             AffinityReal,
+		"NUMERIC":           AffinityNumeric,
+		"DECIMAL(10,5)":     AffinityNumeric,
+		"BOOLEAN":           AffinityNumeric,
+		"CHARINT":           AffinityInteger,
+		"FLOATING POINT":    AffinityInteger,
+		"DATETIME":          AffinityNumeric,
+		"STRING":            AffinityNumeric,
+		"VARYING CHARACTER": AffinityText,
+	}
+	for typ, want := range tests {
+		if got := TypeAffinity(typ); got != want {
+			t.Errorf("TypeAffinity(%q) = %d, want %d", typ, got, want)
+		}
+	}
+}
+
+func TestAffinityApply(t *testing.T) {
+	tests := []struct {
+		a    Affinity
+		v    any
+		want any
+	}{
+		{AffinityText, int64(42), "42"},
+		{AffinityText, 1.5, "1.5"},
+		{AffinityText, 2.0, "2.0"},
+		{AffinityText, "x", "x"},
+		{AffinityInteger, "42", int64(42)},
+		{AffinityInteger, " 42 ", int64(42)},
+		{AffinityInteger, "4.0", int64(4)},
+		{AffinityInteger, "4.5", 4.5},
+		{AffinityInteger, "abc", "abc"},
+		{AffinityNumeric, 3.0, int64(3)},
+		{AffinityReal, int64(3), 3.0},
+		{AffinityReal, "3", 3.0},
+		{AffinityBlob, "42", "42"},
+		{AffinityInteger, []byte("42"), []byte("42")},
+		{AffinityInteger, nil, nil},
+	}
+	for _, tt := range tests {
+		got := tt.a.Apply(tt.v)
+		if b, ok := tt.want.([]byte); ok {
+			if string(got.([]byte)) != string(b) {
+				t.Errorf("%d.Apply(%#v) = %#v, want %#v", tt.a, tt.v, got, tt.want)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%d.Apply(%#v) = %#v, want %#v", tt.a, tt.v, got, tt.want)
+		}
+	}
+}
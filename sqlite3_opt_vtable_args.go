@@ -0,0 +1,224 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VTabArgs are the arguments of Module.Create and Module.Connect, parsed
+// by ParseVTabArgs. For
+//
+//	CREATE VIRTUAL TABLE main.repos USING github('mattn', token='abc', "per page" = 50)
+//
+// Module is "github", Schema is "main", Table is "repos", Positional is
+// ["mattn"] and Options are token = "abc" and "per page" = "50".
+//
+// The getters return errors naming the module and the option, meant to
+// be returned by Create or Connect, so that they surface as the error of
+// CREATE VIRTUAL TABLE.
+type VTabArgs struct {
+	Module string
+	Schema string
+	Table  string
+	// Positional are the arguments that are not key=value options,
+	// unquoted if they are a single quoted string.
+	Positional []string
+	// Options are the key=value arguments, unquoted, by lowercase key.
+	Options map[string]string
+}
+
+// ParseVTabArgs parses the arguments of Module.Create and Module.Connect.
+// Arguments of the form key=value are options, and the others are
+// positional. Keys and values can be quoted as SQL strings or
+// identifiers. Keys are case-insensitive, and must not be repeated.
+func ParseVTabArgs(args []string) (*VTabArgs, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("sqlite3: expected at least 3 virtual table arguments, got %d", len(args))
+	}
+	a := &VTabArgs{
+		Module:  args[0],
+		Schema:  args[1],
+		Table:   args[2],
+		Options: map[string]string{},
+	}
+	for _, arg := range args[3:] {
+		key, value, ok := cutOption(arg)
+		if !ok {
+			a.Positional = append(a.Positional, unquoteSQL(strings.TrimSpace(arg)))
+			continue
+		}
+		key = strings.ToLower(unquoteSQL(strings.TrimSpace(key)))
+		if key == "" {
+			return nil, fmt.Errorf("%s: empty option name in %q", a.Module, arg)
+		}
+		if _, dup := a.Options[key]; dup {
+			return nil, fmt.Errorf("%s: option %s is set more than once", a.Module, key)
+		}
+		a.Options[key] = unquoteSQL(strings.TrimSpace(value))
+	}
+	return a, nil
+}
+
+// cutOption splits arg around its first = outside of quotes.
+func cutOption(arg string) (key, value string, ok bool) {
+	var quote byte
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '=':
+			return arg[:i], arg[i+1:], true
+		}
+	}
+	return arg, "", false
+}
+
+// unquoteSQL removes the quotes of a SQL string or identifier. Other
+// values are returned as is.
+func unquoteSQL(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	first, last := s[0], s[len(s)-1]
+	switch {
+	case first == '[' && last == ']':
+		return s[1 : len(s)-1]
+	case (first == '\'' || first == '"' || first == '`') && last == first:
+		q := string(first)
+		inner := s[1 : len(s)-1]
+		// a lone quote inside means s is not a single quoted value,
+		// e.g. 'a' || 'b'
+		if strings.Count(strings.ReplaceAll(inner, q+q, ""), q) > 0 {
+			return s
+		}
+		return strings.ReplaceAll(inner, q+q, q)
+	}
+	return s
+}
+
+// Has reports whether the option key is set.
+func (a *VTabArgs) Has(key string) bool {
+	_, ok := a.Options[strings.ToLower(key)]
+	return ok
+}
+
+// String returns the option key, or def if it is not set.
+func (a *VTabArgs) String(key, def string) string {
+	if v, ok := a.Options[strings.ToLower(key)]; ok {
+		return v
+	}
+	return def
+}
+
+// Required returns the option key, or an error if it is not set.
+func (a *VTabArgs) Required(key string) (string, error) {
+	v, ok := a.Options[strings.ToLower(key)]
+	if !ok {
+		return "", fmt.Errorf("%s: missing required option %s", a.Module, key)
+	}
+	return v, nil
+}
+
+// Int returns the option key as an integer, or def if it is not set.
+func (a *VTabArgs) Int(key string, def int64) (int64, error) {
+	v, ok := a.Options[strings.ToLower(key)]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 0, 64)
+	if err != nil {
+		return 0, a.invalid(key, "an integer", v)
+	}
+	return i, nil
+}
+
+// Float returns the option key as a number, or def if it is not set.
+func (a *VTabArgs) Float(key string, def float64) (float64, error) {
+	v, ok := a.Options[strings.ToLower(key)]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, a.invalid(key, "a number", v)
+	}
+	return f, nil
+}
+
+// Bool returns the option key as a boolean, or def if it is not set.
+// It accepts the values SQLite accepts for boolean pragmas: 1, 0, true,
+// false, yes, no, on and off.
+func (a *VTabArgs) Bool(key string, def bool) (bool, error) {
+	v, ok := a.Options[strings.ToLower(key)]
+	if !ok {
+		return def, nil
+	}
+	switch strings.ToLower(v) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	}
+	return false, a.invalid(key, "a boolean", v)
+}
+
+// Duration returns the option key as a duration such as "1m30s", or def
+// if it is not set.
+func (a *VTabArgs) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := a.Options[strings.ToLower(key)]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, a.invalid(key, "a duration", v)
+	}
+	return d, nil
+}
+
+// Check returns an error if an option is not one of known, to catch
+// typos in CREATE VIRTUAL TABLE statements.
+func (a *VTabArgs) Check(known ...string) error {
+	var unknown []string
+	for key := range a.Options {
+		found := false
+		for _, k := range known {
+			if strings.EqualFold(k, key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return errors.New(a.Module + ": unknown option " + strings.Join(unknown, ", "))
+}
+
+func (a *VTabArgs) invalid(key, expected, value string) error {
+	return fmt.Errorf("%s: option %s: expected %s, got %q", a.Module, key, expected, value)
+}
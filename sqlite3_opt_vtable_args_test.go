@@ -0,0 +1,135 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVTabArgs(t *testing.T) {
+	a, err := ParseVTabArgs([]string{
+		"github", "main", "repos",
+		"'mattn'",
+		" token = 'it''s'",
+		`"Per Page"=50`,
+		"verbose=on",
+		"timeout=[1m30s]",
+		"ratio = 0.5",
+		"a INT",
+		"'x=y'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Module != "github" || a.Schema != "main" || a.Table != "repos" {
+		t.Fatalf("unexpected names %q %q %q", a.Module, a.Schema, a.Table)
+	}
+	if want := []string{"mattn", "a INT", "x=y"}; !reflect.DeepEqual(a.Positional, want) {
+		t.Fatalf("expected positional arguments %q, got %q", want, a.Positional)
+	}
+	want := map[string]string{
+		"token":    "it's",
+		"per page": "50",
+		"verbose":  "on",
+		"timeout":  "1m30s",
+		"ratio":    "0.5",
+	}
+	if !reflect.DeepEqual(a.Options, want) {
+		t.Fatalf("expected options %q, got %q", want, a.Options)
+	}
+
+	if v := a.String("TOKEN", ""); v != "it's" {
+		t.Fatalf("unexpected token %q", v)
+	}
+	if v := a.String("missing", "def"); v != "def" {
+		t.Fatalf("unexpected default %q", v)
+	}
+	if v, err := a.Int("per page", 10); err != nil || v != 50 {
+		t.Fatalf("unexpected per page %d %v", v, err)
+	}
+	if v, err := a.Bool("verbose", false); err != nil || !v {
+		t.Fatalf("unexpected verbose %v %v", v, err)
+	}
+	if v, err := a.Duration("timeout", 0); err != nil || v != 90*time.Second {
+		t.Fatalf("unexpected timeout %v %v", v, err)
+	}
+	if v, err := a.Float("ratio", 1); err != nil || v != 0.5 {
+		t.Fatalf("unexpected ratio %v %v", v, err)
+	}
+	if _, err := a.Int("token", 0); err == nil || err.Error() != `github: option token: expected an integer, got "it's"` {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := a.Required("owner"); err == nil {
+		t.Fatal("expected an error for a missing required option")
+	}
+	if err := a.Check("token", "per page", "verbose", "timeout"); err == nil || err.Error() != "github: unknown option ratio" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if _, err := ParseVTabArgs([]string{"m", "main", "t", "a=1", "A=2"}); err == nil {
+		t.Fatal("expected an error for a repeated option")
+	}
+	if _, err := ParseVTabArgs([]string{"m", "main"}); err == nil {
+		t.Fatal("expected an error for missing names")
+	}
+}
+
+type vtabArgsModule struct {
+	vtabTxModule
+	args *VTabArgs
+}
+
+func (m *vtabArgsModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	a, err := ParseVTabArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Check("limit"); err != nil {
+		return nil, err
+	}
+	if _, err := a.Int("limit", 100); err != nil {
+		return nil, err
+	}
+	m.args = a
+	return m.vtabTxModule.Create(c, args)
+}
+
+func TestVTabArgsModule(t *testing.T) {
+	m := &vtabArgsModule{}
+	sql.Register("sqlite3_TestVTabArgsModule", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("args", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabArgsModule", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE VIRTUAL TABLE t USING args(limit='ten')")
+	if err == nil || !strings.Contains(err.Error(), `args: option limit: expected an integer, got "ten"`) {
+		t.Fatalf("expected the option error, got %v", err)
+	}
+	_, err = db.Exec("CREATE VIRTUAL TABLE t USING args(limt=10)")
+	if err == nil || !strings.Contains(err.Error(), "args: unknown option limt") {
+		t.Fatalf("expected the unknown option error, got %v", err)
+	}
+	if _, err := db.Exec("CREATE VIRTUAL TABLE t USING args(limit = 10)"); err != nil {
+		t.Fatal(err)
+	}
+	if m.args.Table != "t" || m.args.String("limit", "") != "10" {
+		t.Fatalf("unexpected arguments %+v", m.args)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// TableFuncParam is a parameter of a table-valued function.
+type TableFuncParam struct {
+	// Name is the name of the HIDDEN column holding the parameter, which
+	// can be constrained by name: SELECT * FROM f WHERE name = ?.
+	Name string
+	// Type is the optional declared type of the parameter. Arguments are
+	// converted to its affinity.
+	Type string
+	// Required makes calls without the parameter fail.
+	Required bool
+	// Default is the argument passed to Rows when an optional parameter
+	// is not set.
+	Default any
+}
+
+// TableFunc is a table-valued function, registered with
+// SQLiteConn.CreateTableFunction:
+//
+//	conn.CreateTableFunction("repeat", TableFunc{
+//		Columns: []string{"value TEXT"},
+//		Params: []TableFuncParam{
+//			{Name: "str", Type: "TEXT", Required: true},
+//			{Name: "n", Type: "INTEGER", Default: int64(1)},
+//		},
+//		Rows: func(args []any) ([][]any, error) {
+//			...
+//		},
+//	})
+//
+//	SELECT value FROM repeat('a', 3);
+type TableFunc struct {
+	// Columns are the output columns, each a name optionally followed by
+	// a declared type, e.g. "value INTEGER". Names are quoted, so they can
+	// be keywords such as "limit", but cannot contain spaces.
+	Columns []string
+	// Params are the parameters of the function, in positional order.
+	Params []TableFuncParam
+	// Rows returns the rows of a call. args holds one argument per
+	// parameter, in the order of Params. Each row must hold one value
+	// per output column, of a type supported by VTabCursorBatch.
+	Rows func(args []any) ([][]any, error)
+}
+
+// CreateTableFunction registers the table-valued function f under name.
+// It is an eponymous-only virtual table whose parameters are HIDDEN
+// columns, so calls with missing required arguments fail and arguments
+// are mapped to Params whatever the way they are passed.
+func (c *SQLiteConn) CreateTableFunction(name string, f TableFunc) error {
+	if f.Rows == nil {
+		return errors.New("sqlite3: table function without Rows")
+	}
+	if len(f.Columns) == 0 {
+		return errors.New("sqlite3: table function without columns")
+	}
+	var cols []string
+	for _, def := range f.Columns {
+		def = strings.TrimSpace(def)
+		name, typ := def, ""
+		if i := strings.IndexFunc(def, unicode.IsSpace); i >= 0 {
+			name, typ = def[:i], strings.TrimSpace(def[i:])
+		}
+		if name == "" {
+			return errors.New("sqlite3: table function column without name")
+		}
+		if !validDeclType(typ) {
+			return fmt.Errorf("sqlite3: invalid type %q for table function column %s", typ, name)
+		}
+		cols = append(cols, strings.TrimSpace(quoteIdentifier(name)+" "+typ))
+	}
+	for _, p := range f.Params {
+		if !validDeclType(p.Type) {
+			return fmt.Errorf("sqlite3: invalid type %q for table function parameter %s", p.Type, p.Name)
+		}
+		cols = append(cols, strings.TrimSpace(quoteIdentifier(p.Name)+" "+p.Type)+" HIDDEN")
+	}
+	return c.CreateModule(name, &tableFuncModule{name: name, f: f, cols: cols})
+}
+
+type tableFuncModule struct {
+	name string
+	f    TableFunc
+	// cols are the definitions of the columns, output columns first
+	cols []string
+}
+
+func (m *tableFuncModule) EponymousOnlyModule() {}
+
+func (m *tableFuncModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(" + strings.Join(m.cols, ", ") + ")")
+	if err != nil {
+		return nil, err
+	}
+	return &tableFuncTable{m}, nil
+}
+
+func (m *tableFuncModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *tableFuncModule) DestroyModule() {}
+
+type tableFuncTable struct {
+	m *tableFuncModule
+}
+
+// param returns the index of the parameter of column col, or -1.
+func (v *tableFuncTable) param(col int) int {
+	i := col - len(v.m.f.Columns)
+	if i < 0 || i >= len(v.m.f.Params) {
+		return -1
+	}
+	return i
+}
+
+func (v *tableFuncTable) BestIndex(csts []InfoConstraint, obs []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	res := &IndexResult{
+		Used: make([]bool, len(csts)),
+		Omit: make([]bool, len(csts)),
+	}
+	set := make([]bool, len(v.m.f.Params))
+	constrained := make([]bool, len(v.m.f.Params))
+	for i, c := range csts {
+		p := v.param(c.Column)
+		if p < 0 || c.Op != OpEQ {
+			continue
+		}
+		constrained[p] = true
+		if !c.Usable || set[p] {
+			continue
+		}
+		set[p] = true
+		res.Used[i] = true
+		res.Omit[i] = true
+	}
+	for i, p := range v.m.f.Params {
+		if !p.Required || set[i] {
+			continue
+		}
+		if constrained[i] {
+			// the argument is only missing from this plan
+			return nil, ErrConstraint
+		}
+		return nil, fmt.Errorf("%s: missing required argument %s", v.m.name, p.Name)
+	}
+	res.EstimatedCost = 1000
+	res.EstimatedRows = 1000
+	return res, nil
+}
+
+func (v *tableFuncTable) ColumnAffinity(col int) Affinity {
+	if p := v.param(col); p >= 0 {
+		return TypeAffinity(v.m.f.Params[p].Type)
+	}
+	return AffinityBlob
+}
+
+func (v *tableFuncTable) Disconnect() error { return nil }
+
+func (v *tableFuncTable) Destroy() error { return nil }
+
+func (v *tableFuncTable) Open() (VTabCursor, error) {
+	return &tableFuncCursor{t: v}, nil
+}
+
+// tableFuncCursor is a batch cursor that returns all the rows of a call
+// in a single batch, followed by the arguments of the call.
+type tableFuncCursor struct {
+	t    *tableFuncTable
+	args []any
+	done bool
+}
+
+func (vc *tableFuncCursor) Close() error { return nil }
+
+func (vc *tableFuncCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	return errors.New("sqlite3: table function called without FilterArgs")
+}
+
+func (vc *tableFuncCursor) FilterArgs(idxNum int, idxStr string, args []FilterArg) error {
+	params := vc.t.m.f.Params
+	vc.args = make([]any, len(params))
+	for i, p := range params {
+		vc.args[i] = p.Default
+	}
+	for _, a := range args {
+		vc.args[vc.t.param(a.Column)] = a.Value
+	}
+	vc.done = false
+	return nil
+}
+
+func (vc *tableFuncCursor) NextBatch() ([][]any, error) {
+	if vc.done {
+		return nil, nil
+	}
+	vc.done = true
+	rows, err := vc.t.m.f.Rows(vc.args)
+	if err != nil {
+		return nil, err
+	}
+	n := len(vc.t.m.f.Columns)
+	for i, row := range rows {
+		if len(row) != n {
+			return nil, fmt.Errorf("%s: row %d has %d values, expected %d", vc.t.m.name, i, len(row), n)
+		}
+		rows[i] = append(row[:n:n], vc.args...)
+	}
+	return rows, nil
+}
+
+func (vc *tableFuncCursor) Next() error { return nil }
+
+func (vc *tableFuncCursor) EOF() bool { return true }
+
+func (vc *tableFuncCursor) Column(c *SQLiteContext, col int) error { return nil }
+
+func (vc *tableFuncCursor) Rowid() (int64, error) { return 0, nil }
@@ -0,0 +1,106 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateTableFunction(t *testing.T) {
+	var calls [][]any
+	var badType error
+	sql.Register("sqlite3_TestCreateTableFunction", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			badType = conn.CreateTableFunction("bad", TableFunc{
+				Columns: []string{"value"},
+				Params:  []TableFuncParam{{Name: "p", Type: "TEXT) --"}},
+				Rows:    func(args []any) ([][]any, error) { return nil, nil },
+			})
+			if err := conn.CreateTableFunction("bad_column", TableFunc{
+				Columns: []string{"value TEXT, p HIDDEN"},
+				Rows:    func(args []any) ([][]any, error) { return nil, nil },
+			}); err == nil || !strings.Contains(err.Error(), `invalid type "TEXT, p HIDDEN"`) {
+				t.Errorf("expected an invalid type error for a column, got %v", err)
+			}
+			return conn.CreateTableFunction("repeat", TableFunc{
+				Columns: []string{"value TEXT", "i INTEGER", "order"},
+				Params: []TableFuncParam{
+					{Name: "str", Type: "TEXT", Required: true},
+					{Name: "limit", Type: "INTEGER", Default: int64(2)},
+				},
+				Rows: func(args []any) ([][]any, error) {
+					calls = append(calls, args)
+					var rows [][]any
+					for i := int64(0); i < args[1].(int64); i++ {
+						rows = append(rows, []any{args[0], i, -i})
+					}
+					return rows, nil
+				},
+			})
+		},
+	})
+	db, err := sql.Open("sqlite3_TestCreateTableFunction", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	query := func(q string, args ...any) []string {
+		t.Helper()
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		defer rows.Close()
+		var res []string
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, s)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return res
+	}
+
+	if got := query("SELECT value || i FROM repeat('a', '3')"); !reflect.DeepEqual(got, []string{"a0", "a1", "a2"}) {
+		t.Fatalf("unexpected rows for positional arguments: %v", got)
+	}
+	if got := query(`SELECT "order" FROM repeat('c', 2)`); !reflect.DeepEqual(got, []string{"0", "-1"}) {
+		t.Fatalf("unexpected rows for a column named after a keyword: %v", got)
+	}
+	if got := query("SELECT value || i FROM repeat WHERE str = ?", "b"); !reflect.DeepEqual(got, []string{"b0", "b1"}) {
+		t.Fatalf("unexpected rows for the default argument: %v", got)
+	}
+	if got := query(`SELECT str || "limit" FROM repeat('c', 1) WHERE "limit" > 0`); !reflect.DeepEqual(got, []string{"c1"}) {
+		t.Fatalf("unexpected argument columns: %v", got)
+	}
+	if got := query("SELECT r.value FROM (SELECT 'x' AS s UNION ALL SELECT 'y') JOIN repeat(s, 1) r"); !reflect.DeepEqual(got, []string{"x", "y"}) {
+		t.Fatalf("unexpected rows for a join: %v", got)
+	}
+	if !reflect.DeepEqual(calls[0], []any{"a", int64(3)}) {
+		t.Fatalf("expected the arguments to be converted to the parameter affinities, got %#v", calls[0])
+	}
+
+	if badType == nil || !strings.Contains(badType.Error(), `invalid type "TEXT) --"`) {
+		t.Fatalf("expected an invalid type error, got %v", badType)
+	}
+
+	_, err = db.Query("SELECT * FROM repeat")
+	if err == nil || !strings.Contains(err.Error(), "missing required argument str") {
+		t.Fatalf("expected a missing argument error, got %v", err)
+	}
+}
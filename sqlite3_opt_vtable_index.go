@@ -0,0 +1,244 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IndexColumn declares the constraints a virtual table can push down on
+// one of its columns.
+type IndexColumn struct {
+	// Column is the index of the column, -1 for the rowid.
+	Column int
+	// Ops are the operators the virtual table can handle for the column.
+	Ops []Op
+	// Required makes plans without a usable constraint on the column
+	// invalid, e.g. for an API parameter that must always be set.
+	Required bool
+	// Omit tells SQLite that the virtual table enforces the constraints
+	// on the column exactly, so it does not need to check them again.
+	Omit bool
+	// In asks for IN lists on the column to be passed all at once.
+	// See IndexResult.In.
+	In bool
+	// Selectivity is the estimated fraction of the rows left once the
+	// column is constrained. It defaults to 0.1 for OpEQ and 0.5 for
+	// the other operators.
+	Selectivity float64
+}
+
+// IndexSpec declares the pushdown capabilities of a virtual table, and
+// computes IndexResult from them. Plans are serialized into IdxStr and
+// decoded in Filter with DecodeIndexPlan.
+//
+//	func (t *table) BestIndex(csts []InfoConstraint, obs []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+//		return t.spec.BestIndex(csts, obs, info)
+//	}
+//
+//	func (c *cursor) Filter(idxNum int, idxStr string, vals []any) error {
+//		plan, err := DecodeIndexPlan(idxStr, vals)
+//		...
+//	}
+type IndexSpec struct {
+	Columns []IndexColumn
+	// Limit and Offset tell whether LIMIT and OFFSET can be pushed down.
+	Limit  bool
+	Offset bool
+	// Rows is the estimated number of rows of a full scan.
+	// It defaults to 1000000.
+	Rows float64
+	// Cost optionally overrides the estimated cost and number of rows
+	// of a plan.
+	Cost func(plan *IndexPlan) (cost float64, rows float64)
+}
+
+// PlanConstraint is a constraint of an IndexPlan.
+type PlanConstraint struct {
+	Column int
+	Op     Op
+	// Value is the Filter argument of the constraint. It is only set on
+	// plans returned by DecodeIndexPlan.
+	Value any
+}
+
+// IndexPlan is a query plan chosen by IndexSpec.BestIndex.
+type IndexPlan struct {
+	// Constraints are the pushed down constraints, in Filter argument order.
+	Constraints []PlanConstraint
+}
+
+func (s *IndexSpec) column(col int) *IndexColumn {
+	for i := range s.Columns {
+		if s.Columns[i].Column == col {
+			return &s.Columns[i]
+		}
+	}
+	return nil
+}
+
+func (c *IndexColumn) supports(op Op) bool {
+	for _, o := range c.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// BestIndex computes the IndexResult of the constraints csts according to
+// the capabilities declared by s. It returns ErrConstraint when a
+// required column has no usable constraint.
+func (s *IndexSpec) BestIndex(csts []InfoConstraint, obs []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	res := &IndexResult{
+		Used: make([]bool, len(csts)),
+		Omit: make([]bool, len(csts)),
+		In:   make([]bool, len(csts)),
+	}
+	plan := &IndexPlan{}
+	rows := s.Rows
+	if rows <= 0 {
+		rows = 1000000
+	}
+
+	for i, c := range csts {
+		if !c.Usable {
+			continue
+		}
+		switch c.Op {
+		case OpLIMIT:
+			if !s.Limit {
+				continue
+			}
+		case OpOFFSET:
+			if !s.Offset {
+				continue
+			}
+		default:
+			col := s.column(c.Column)
+			if col == nil || !col.supports(c.Op) {
+				continue
+			}
+			res.Omit[i] = col.Omit
+			res.In[i] = col.In
+			selectivity := col.Selectivity
+			if selectivity <= 0 {
+				selectivity = 0.5
+				if c.Op == OpEQ {
+					selectivity = 0.1
+				}
+			}
+			rows *= selectivity
+		}
+		res.Used[i] = true
+		plan.Constraints = append(plan.Constraints, PlanConstraint{Column: c.Column, Op: c.Op})
+	}
+
+	for _, col := range s.Columns {
+		if col.Required && !plan.has(col.Column) {
+			return nil, ErrConstraint
+		}
+	}
+
+	res.IdxStr = plan.String()
+	res.IdxNum = len(plan.Constraints)
+	res.EstimatedRows = rows
+	res.EstimatedCost = rows
+	if s.Cost != nil {
+		res.EstimatedCost, res.EstimatedRows = s.Cost(plan)
+	}
+	return res, nil
+}
+
+func (p *IndexPlan) has(col int) bool {
+	for _, c := range p.Constraints {
+		if c.Column == col && c.Op != OpLIMIT && c.Op != OpOFFSET {
+			return true
+		}
+	}
+	return false
+}
+
+// String serializes the plan. It is the IdxStr set by IndexSpec.BestIndex.
+func (p *IndexPlan) String() string {
+	parts := make([]string, len(p.Constraints))
+	for i, c := range p.Constraints {
+		parts[i] = strconv.Itoa(c.Column) + ":" + strconv.Itoa(int(c.Op))
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeIndexPlan decodes the plan serialized in idxStr by
+// IndexSpec.BestIndex and attaches the Filter arguments vals to its
+// constraints.
+func DecodeIndexPlan(idxStr string, vals []any) (*IndexPlan, error) {
+	plan := &IndexPlan{}
+	if idxStr != "" {
+		for _, part := range strings.Split(idxStr, ",") {
+			col, op, ok := strings.Cut(part, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid index plan %q", idxStr)
+			}
+			c, err := strconv.Atoi(col)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index plan %q: %v", idxStr, err)
+			}
+			o, err := strconv.ParseUint(op, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index plan %q: %v", idxStr, err)
+			}
+			plan.Constraints = append(plan.Constraints, PlanConstraint{Column: c, Op: Op(o)})
+		}
+	}
+	if len(vals) != len(plan.Constraints) {
+		return nil, fmt.Errorf("index plan %q expects %d arguments, got %d", idxStr, len(plan.Constraints), len(vals))
+	}
+	for i, v := range vals {
+		// work around for SQLITE_NULL
+		if z, ok := v.([]byte); ok && z == nil {
+			v = nil
+		}
+		plan.Constraints[i].Value = v
+	}
+	return plan, nil
+}
+
+// Value returns the value of the first constraint on column col with
+// operator op.
+func (p *IndexPlan) Value(col int, op Op) (any, bool) {
+	for _, c := range p.Constraints {
+		if c.Column == col && c.Op == op && c.Op != OpLIMIT && c.Op != OpOFFSET {
+			return c.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Limit returns the pushed down LIMIT, if any.
+func (p *IndexPlan) Limit() (int64, bool) {
+	return p.intValue(OpLIMIT)
+}
+
+// Offset returns the pushed down OFFSET, if any.
+func (p *IndexPlan) Offset() (int64, bool) {
+	return p.intValue(OpOFFSET)
+}
+
+func (p *IndexPlan) intValue(op Op) (int64, bool) {
+	for _, c := range p.Constraints {
+		if c.Op == op {
+			i, ok := c.Value.(int64)
+			return i, ok
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+var testIndexSpec = IndexSpec{
+	Columns: []IndexColumn{
+		{Column: 0, Ops: []Op{OpEQ}, Required: true, Omit: true},
+		{Column: 1, Ops: []Op{OpGT, OpLT}},
+	},
+	Limit: true,
+}
+
+func TestIndexSpecBestIndex(t *testing.T) {
+	csts := []InfoConstraint{
+		{Column: 1, Op: OpGT, Usable: true},
+		{Column: 2, Op: OpEQ, Usable: true},
+		{Column: 0, Op: OpEQ, Usable: true},
+		{Column: 1, Op: OpLE, Usable: true},
+		{Column: 0, Op: OpLIMIT, Usable: true},
+		{Column: 0, Op: OpOFFSET, Usable: true},
+	}
+	res, err := testIndexSpec.BestIndex(csts, nil, IndexInformation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false, true, false, true, false}; !reflect.DeepEqual(res.Used, want) {
+		t.Fatalf("expected used constraints %v, got %v", want, res.Used)
+	}
+	if want := []bool{false, false, true, false, false, false}; !reflect.DeepEqual(res.Omit, want) {
+		t.Fatalf("expected omitted constraints %v, got %v", want, res.Omit)
+	}
+	if res.IdxStr != "1:4,0:2,0:73" || res.IdxNum != 3 {
+		t.Fatalf("unexpected plan %d %q", res.IdxNum, res.IdxStr)
+	}
+	if res.EstimatedRows != 1000000*0.5*0.1 {
+		t.Fatalf("unexpected estimated rows %v", res.EstimatedRows)
+	}
+
+	plan, err := DecodeIndexPlan(res.IdxStr, []any{int64(3), "go", int64(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := plan.Value(0, OpEQ); !ok || v != "go" {
+		t.Fatalf("expected EQ value on column 0, got %v", v)
+	}
+	if v, ok := plan.Value(1, OpGT); !ok || v != int64(3) {
+		t.Fatalf("expected GT value on column 1, got %v", v)
+	}
+	if _, ok := plan.Value(1, OpLT); ok {
+		t.Fatal("unexpected LT value on column 1")
+	}
+	if l, ok := plan.Limit(); !ok || l != 10 {
+		t.Fatalf("expected limit 10, got %v", l)
+	}
+	if _, ok := plan.Offset(); ok {
+		t.Fatal("unexpected offset")
+	}
+}
+
+func TestIndexSpecRequired(t *testing.T) {
+	csts := []InfoConstraint{
+		{Column: 0, Op: OpEQ, Usable: false},
+		{Column: 1, Op: OpGT, Usable: true},
+	}
+	_, err := testIndexSpec.BestIndex(csts, nil, IndexInformation{})
+	if err != ErrConstraint {
+		t.Fatalf("expected ErrConstraint, got %v", err)
+	}
+}
+
+func TestDecodeIndexPlanErrors(t *testing.T) {
+	for _, tt := range []struct {
+		idxStr string
+		vals   []any
+	}{
+		{"0", []any{1}},
+		{"x:2", []any{1}},
+		{"0:300", []any{1}},
+		{"0:2", nil},
+		{"", []any{1}},
+	} {
+		if _, err := DecodeIndexPlan(tt.idxStr, tt.vals); err == nil {
+			t.Errorf("expected an error decoding %q with %v", tt.idxStr, tt.vals)
+		}
+	}
+}
+
+type indexSpecModule struct {
+	plans []*IndexPlan
+}
+
+func (m *indexSpecModule) EponymousOnlyModule() {}
+
+func (m *indexSpecModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(owner TEXT, stars INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &indexSpecTable{m}, nil
+}
+
+func (m *indexSpecModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *indexSpecModule) DestroyModule() {}
+
+type indexSpecTable struct {
+	m *indexSpecModule
+}
+
+func (v *indexSpecTable) BestIndex(csts []InfoConstraint, obs []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return testIndexSpec.BestIndex(csts, obs, info)
+}
+
+func (v *indexSpecTable) Disconnect() error { return nil }
+
+func (v *indexSpecTable) Destroy() error { return nil }
+
+func (v *indexSpecTable) Open() (VTabCursor, error) {
+	return &indexSpecCursor{m: v.m}, nil
+}
+
+type indexSpecCursor struct {
+	m *indexSpecModule
+}
+
+func (vc *indexSpecCursor) Close() error { return nil }
+
+func (vc *indexSpecCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	plan, err := DecodeIndexPlan(idxStr, vals)
+	if err != nil {
+		return err
+	}
+	vc.m.plans = append(vc.m.plans, plan)
+	return nil
+}
+
+func (vc *indexSpecCursor) Next() error { return nil }
+
+func (vc *indexSpecCursor) EOF() bool { return true }
+
+func (vc *indexSpecCursor) Column(c *SQLiteContext, col int) error { return nil }
+
+func (vc *indexSpecCursor) Rowid() (int64, error) { return 0, nil }
+
+func TestIndexSpecModule(t *testing.T) {
+	m := &indexSpecModule{}
+	sql.Register("sqlite3_TestIndexSpecModule", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("repos", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestIndexSpecModule", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("SELECT * FROM repos WHERE stars > 100 AND owner = 'mattn'")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	if len(m.plans) != 1 {
+		t.Fatalf("expected exactly one Filter call, got %d", len(m.plans))
+	}
+	if v, ok := m.plans[0].Value(0, OpEQ); !ok || v != "mattn" {
+		t.Fatalf("expected owner to be pushed down, got %v", m.plans[0])
+	}
+	if v, ok := m.plans[0].Value(1, OpGT); !ok || v != int64(100) {
+		t.Fatalf("expected stars to be pushed down, got %v", m.plans[0])
+	}
+
+	_, err = db.Exec("SELECT * FROM repos WHERE stars > 100")
+	if err == nil {
+		t.Fatal("expected an error without the required owner constraint")
+	}
+}
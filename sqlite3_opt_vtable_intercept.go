@@ -0,0 +1,236 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VTabCall describes a call SQLite makes to a virtual table, passed to
+// the interceptors of the table.
+type VTabCall struct {
+	// Context is the context of the statement being run.
+	Context context.Context
+	Module  string
+	Schema  string
+	Table   string
+	// Method is the name of the Go method being called: Create, Connect,
+	// Disconnect, Destroy, BestIndex, Open, Filter, Next, NextBatch,
+	// Close, Update, Begin, Sync, Commit, Rollback, Savepoint, Release,
+	// RollbackTo or Rename. Column, Rowid and EOF are not intercepted.
+	Method string
+
+	// Constraints and OrderBy are the arguments of BestIndex, and Plan
+	// its result once next returns.
+	Constraints []InfoConstraint
+	OrderBy     []InfoOrderBy
+	Plan        *IndexResult
+
+	// IdxNum, IdxStr and Args are the arguments of Filter.
+	IdxNum int
+	IdxStr string
+	Args   []any
+
+	// Rows is the number of rows of the batch returned by NextBatch once
+	// next returns, and the number of rows returned by the cursor for
+	// Close.
+	Rows int64
+}
+
+// VTabInterceptor intercepts the calls to virtual tables, to log, time
+// or trace them. It must call next to make the call, and return its
+// error, or another one to fail the call.
+//
+// Interceptors are applied when SQLite calls the table, so the optional
+// interfaces of the module, its tables and cursors keep working, which
+// would not be the case if they were wrapped.
+type VTabInterceptor func(call *VTabCall, next func() error) error
+
+// vtabInterceptors are the interceptors of a connection, and of its
+// modules by lowercase name.
+type vtabInterceptors struct {
+	mu      sync.Mutex
+	conn    []VTabInterceptor
+	modules map[string][]VTabInterceptor
+	// registered are the modules of the connection, whose chains are
+	// updated when interceptors are added
+	registered []*sqliteModule
+}
+
+// InterceptVTabs adds interceptors to all the virtual tables of the
+// connection. Interceptors run in the order they are added, those of the
+// connection before those of the module.
+func (c *SQLiteConn) InterceptVTabs(interceptors ...VTabInterceptor) {
+	i := &c.vtabs.interceptors
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.conn = append(i.conn, interceptors...)
+	for _, m := range i.registered {
+		m.chain.Store(i.chain(m.name))
+	}
+}
+
+// InterceptModule adds interceptors to the virtual tables of the module
+// named module, registered before or after the call.
+func (c *SQLiteConn) InterceptModule(module string, interceptors ...VTabInterceptor) {
+	i := &c.vtabs.interceptors
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.modules == nil {
+		i.modules = map[string][]VTabInterceptor{}
+	}
+	name := strings.ToLower(module)
+	i.modules[name] = append(i.modules[name], interceptors...)
+	for _, m := range i.registered {
+		if strings.EqualFold(m.name, module) {
+			m.chain.Store(i.chain(m.name))
+		}
+	}
+}
+
+// chain returns the interceptors of the module named module, or nil. It
+// must be called with i.mu held.
+func (i *vtabInterceptors) chain(module string) *[]VTabInterceptor {
+	module = strings.ToLower(module)
+	if len(i.conn) == 0 && len(i.modules[module]) == 0 {
+		return nil
+	}
+	chain := append(append([]VTabInterceptor{}, i.conn...), i.modules[module]...)
+	return &chain
+}
+
+// register adds m to the modules of the connection, and sets its chain.
+func (i *vtabInterceptors) register(m *sqliteModule) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.registered = append(i.registered, m)
+	m.chain.Store(i.chain(m.name))
+}
+
+// unregister removes m, which is destroyed, from the modules of the
+// connection.
+func (i *vtabInterceptors) unregister(m *sqliteModule) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.registered = slices.DeleteFunc(i.registered, func(r *sqliteModule) bool { return r == m })
+}
+
+// intercepted reports whether the calls to the tables of m are
+// intercepted. The callers of intercept on the paths run for each row or
+// scan check it first, so that they do not allocate the call and its
+// closure otherwise.
+func (m *sqliteModule) intercepted() bool {
+	return m.chain.Load() != nil
+}
+
+// intercept makes call, running fn through the interceptors of the
+// module m. Context, Module, Schema and Table are set on call.
+func (m *sqliteModule) intercept(schema, table string, call *VTabCall, fn func() error) error {
+	chain := m.chain.Load()
+	if chain == nil {
+		return fn()
+	}
+	call.Context = m.c.stepContext()
+	call.Module, call.Schema, call.Table = m.name, schema, table
+	next := fn
+	for j := len(*chain) - 1; j >= 0; j-- {
+		ic, n := (*chain)[j], next
+		next = func() error { return ic(call, n) }
+	}
+	return next()
+}
+
+// intercept makes call to vt, see sqliteModule.intercept.
+func (vt *sqliteVTab) intercept(call *VTabCall, fn func() error) error {
+	return vt.module.intercept(vt.schema, vt.table, call, fn)
+}
+
+// logVTabPlansKept is the number of plans LogVTabPlans keeps by table.
+const logVTabPlansKept = 8
+
+// LogVTabPlans returns an interceptor logging the plans chosen by
+// virtual tables, i.e. the idxNum, idxStr and estimated cost returned by
+// BestIndex and passed to Filter, and the number of rows returned by
+// cursors when they are closed. Failed calls are logged at level
+// slog.LevelError.
+func LogVTabPlans(logger *slog.Logger, level slog.Level) VTabInterceptor {
+	type plan struct {
+		idxNum int
+		idxStr string
+		cost   float64
+	}
+	var mu sync.Mutex
+	// plans are the last plans returned by BestIndex for each table, as
+	// Filter only receives idxNum and idxStr. SQLite evaluates a few plans
+	// when preparing a statement, the one it chooses is usually the last.
+	plans := map[vtabKey][]plan{}
+	return func(call *VTabCall, next func() error) error {
+		start := time.Now()
+		err := next()
+		attrs := []slog.Attr{
+			slog.String("module", call.Module),
+			slog.String("schema", call.Schema),
+			slog.String("table", call.Table),
+		}
+		if err == ErrConstraint && call.Method == "BestIndex" {
+			// the plan is unusable, not failed
+			return err
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("method", call.Method), slog.Any("error", err))
+			logger.LogAttrs(call.Context, slog.LevelError, "virtual table call failed", attrs...)
+			return err
+		}
+		switch call.Method {
+		case "BestIndex":
+			if call.Plan == nil {
+				break
+			}
+			mu.Lock()
+			key := vtabKey{call.Module, call.Schema, call.Table}
+			p := plans[key]
+			if len(p) == logVTabPlansKept {
+				p = p[1:]
+			}
+			plans[key] = append(p, plan{call.Plan.IdxNum, call.Plan.IdxStr, call.Plan.EstimatedCost})
+			mu.Unlock()
+		case "Filter":
+			var cost float64
+			ok := false
+			mu.Lock()
+			p := plans[vtabKey{call.Module, call.Schema, call.Table}]
+			for j := len(p) - 1; j >= 0 && !ok; j-- {
+				if p[j].idxNum == call.IdxNum && p[j].idxStr == call.IdxStr {
+					cost, ok = p[j].cost, true
+				}
+			}
+			mu.Unlock()
+			attrs = append(attrs,
+				slog.Int("idxNum", call.IdxNum),
+				slog.String("idxStr", call.IdxStr),
+				slog.Int("args", len(call.Args)),
+				slog.Duration("duration", time.Since(start)),
+			)
+			if ok {
+				attrs = append(attrs, slog.Float64("cost", cost))
+			}
+			logger.LogAttrs(call.Context, level, "virtual table scan", attrs...)
+		case "Close":
+			attrs = append(attrs, slog.Int64("rows", call.Rows))
+			logger.LogAttrs(call.Context, level, "virtual table cursor closed", attrs...)
+		}
+		return nil
+	}
+}
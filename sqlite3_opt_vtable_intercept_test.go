@@ -0,0 +1,163 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVTabInterceptors(t *testing.T) {
+	repos, err := SliceModule([]structRepo{
+		{Owner: "mattn", Name: "go-sqlite3"},
+		{Owner: "mattn", Name: "gom"},
+		{Owner: "julien040", Name: "anyquery"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := SliceModule([]structRepo{{Owner: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var trace []string
+	record := func(prefix string) VTabInterceptor {
+		return func(call *VTabCall, next func() error) error {
+			if call.Method == "Filter" {
+				trace = append(trace, prefix+" "+call.Table)
+			}
+			return next()
+		}
+	}
+	metrics := NewVTabMetrics()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	sql.Register("sqlite3_TestVTabInterceptors", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			conn.InterceptModule("REPOS", record("module"))
+			if err := conn.CreateModule("repos", repos); err != nil {
+				return err
+			}
+			if err := conn.CreateModule("denied", denied); err != nil {
+				return err
+			}
+			// interceptors apply to the modules registered before
+			conn.InterceptVTabs(metrics.Intercept, LogVTabPlans(logger, slog.LevelInfo), record("conn"))
+			conn.InterceptModule("Denied", func(call *VTabCall, next func() error) error {
+				if call.Method == "Filter" {
+					return errors.New("access denied")
+				}
+				return next()
+			})
+			return nil
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabInterceptors", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name FROM repos WHERE owner = 'mattn'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(names, []string{"go-sqlite3", "gom"}) {
+		t.Fatalf("unexpected rows %q", names)
+	}
+	if want := []string{"conn repos", "module repos"}; !reflect.DeepEqual(trace, want) {
+		t.Fatalf("expected the interceptors of the connection to run first, got %q", trace)
+	}
+
+	_, err = db.Exec("SELECT * FROM denied")
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatalf("expected the interceptor error, got %v", err)
+	}
+
+	stats := metrics.Snapshot()
+	if len(stats) != 2 || stats[1].Table != "repos" || stats[0].Table != "denied" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	s := stats[1]
+	if s.Module != "repos" || s.Schema != "main" || s.Scans != 1 || s.Rows != 2 || s.Calls["BestIndex"] == 0 || s.Calls["Close"] != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if h := s.Latency["Filter"]; h.Count != 1 || len(h.Counts) != len(h.Bounds)+1 {
+		t.Fatalf("unexpected Filter latency %+v", h)
+	}
+	if stats[0].Errors["Filter"] != 1 {
+		t.Fatalf("expected a Filter error, got %+v", stats[0].Errors)
+	}
+
+	var scan, failed map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case entry["msg"] == "virtual table scan" && entry["table"] == "repos":
+			scan = entry
+		case entry["msg"] == "virtual table call failed":
+			failed = entry
+		}
+	}
+	if scan == nil || scan["args"] != 1.0 || scan["cost"] != 10000.0 {
+		t.Fatalf("unexpected scan log %v in %s", scan, logs.String())
+	}
+	if failed == nil || failed["table"] != "denied" || failed["method"] != "Filter" || failed["level"] != "ERROR" {
+		t.Fatalf("unexpected error log %v in %s", failed, logs.String())
+	}
+}
+
+func TestLogVTabPlansNoPlan(t *testing.T) {
+	m := &vtabPlanModule{
+		schema:    "CREATE TABLE x(a)",
+		bestIndex: func(cst []InfoConstraint) *IndexResult { return nil },
+	}
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	sql.Register("sqlite3_TestLogVTabPlansNoPlan", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			if err := conn.CreateModule("noplan", m); err != nil {
+				return err
+			}
+			conn.InterceptVTabs(LogVTabPlans(logger, slog.LevelInfo))
+			return nil
+		},
+	})
+	db, err := sql.Open("sqlite3_TestLogVTabPlansNoPlan", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("SELECT * FROM noplan")
+	if err == nil || !strings.Contains(err.Error(), "no index result") || strings.Contains(err.Error(), "panic") {
+		t.Fatalf("expected a missing index result error, got %v", err)
+	}
+}
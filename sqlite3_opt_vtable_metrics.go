@@ -0,0 +1,175 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBounds are the bounds of the buckets of LatencyHistogram.
+var latencyBounds = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts the calls of a method by duration.
+type LatencyHistogram struct {
+	// Bounds are the upper bounds of the buckets, from 10µs to 10s.
+	Bounds []time.Duration
+	// Counts are the numbers of calls that lasted at most the bound at
+	// the same index, and longer than the previous one. The last count
+	// is for the calls longer than all the bounds.
+	Counts []int64
+	Count  int64
+	Total  time.Duration
+}
+
+// Mean returns the average duration of the calls.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Bounds = latencyBounds
+		h.Counts = make([]int64, len(latencyBounds)+1)
+	}
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Total += d
+}
+
+// VTabStats are the statistics of a virtual table, see VTabMetrics.
+type VTabStats struct {
+	Module string
+	Schema string
+	Table  string
+	// Calls and Errors count the calls, and the failed ones, by method.
+	Calls  map[string]int64
+	Errors map[string]int64
+	// Latency are the durations of the calls by method.
+	Latency map[string]LatencyHistogram
+	// Scans is the number of calls to Filter, and Rows the number of
+	// rows returned by the cursors.
+	Scans int64
+	Rows  int64
+}
+
+// VTabMetrics collects the statistics of virtual tables. Its Intercept
+// method is a VTabInterceptor:
+//
+//	metrics := sqlite3.NewVTabMetrics()
+//	conn.InterceptVTabs(metrics.Intercept)
+//	...
+//	for _, s := range metrics.Snapshot() {
+//		fmt.Println(s.Table, s.Scans, s.Rows, s.Latency["Filter"].Mean())
+//	}
+type VTabMetrics struct {
+	mu     sync.Mutex
+	tables map[vtabKey]*VTabStats
+}
+
+type vtabKey struct {
+	module, schema, table string
+}
+
+// NewVTabMetrics returns an empty VTabMetrics.
+func NewVTabMetrics() *VTabMetrics {
+	return &VTabMetrics{tables: map[vtabKey]*VTabStats{}}
+}
+
+// Intercept records call. See VTabInterceptor.
+func (m *VTabMetrics) Intercept(call *VTabCall, next func() error) error {
+	start := time.Now()
+	err := next()
+	d := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := vtabKey{call.Module, call.Schema, call.Table}
+	s, ok := m.tables[key]
+	if !ok {
+		s = &VTabStats{
+			Module:  call.Module,
+			Schema:  call.Schema,
+			Table:   call.Table,
+			Calls:   map[string]int64{},
+			Errors:  map[string]int64{},
+			Latency: map[string]LatencyHistogram{},
+		}
+		m.tables[key] = s
+	}
+	s.Calls[call.Method]++
+	// an unusable plan is not an error
+	if err != nil && !(err == ErrConstraint && call.Method == "BestIndex") {
+		s.Errors[call.Method]++
+	}
+	h := s.Latency[call.Method]
+	h.observe(d)
+	s.Latency[call.Method] = h
+	switch call.Method {
+	case "Filter":
+		s.Scans++
+	case "Close":
+		s.Rows += call.Rows
+	}
+	return err
+}
+
+// Snapshot returns a copy of the statistics of the tables, sorted by
+// module, schema and table.
+func (m *VTabMetrics) Snapshot() []VTabStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]VTabStats, 0, len(m.tables))
+	for _, s := range m.tables {
+		c := *s
+		c.Calls = maps.Clone(s.Calls)
+		c.Errors = maps.Clone(s.Errors)
+		c.Latency = make(map[string]LatencyHistogram, len(s.Latency))
+		for k, v := range s.Latency {
+			v.Bounds = slices.Clone(v.Bounds)
+			v.Counts = slices.Clone(v.Counts)
+			c.Latency[k] = v
+		}
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		if a.Schema != b.Schema {
+			return a.Schema < b.Schema
+		}
+		return a.Table < b.Table
+	})
+	return stats
+}
+
+// Reset clears the statistics.
+func (m *VTabMetrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tables = map[vtabKey]*VTabStats{}
+}
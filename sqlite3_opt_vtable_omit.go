@@ -0,0 +1,16 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !sqlite_vtable && !vtable
+// +build !sqlite_vtable,!vtable
+
+package sqlite3
+
+// vtabConn is the state of the virtual tables of a connection, which has
+// none without the sqlite_vtable build tag.
+type vtabConn struct {
+	// gen stays 0, as no virtual table schema can be invalidated
+	gen uint64
+}
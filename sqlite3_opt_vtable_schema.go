@@ -0,0 +1,220 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SchemaColumn is a column of a VTabSchema.
+type SchemaColumn struct {
+	Name string
+	// Type is the declared type of the column, e.g. "INTEGER" or
+	// "VARCHAR(255)". It determines the affinity of the column.
+	Type string
+	// Hidden columns are left out of SELECT * and INSERT without a
+	// column list, e.g. the arguments of table-valued functions.
+	Hidden     bool
+	PrimaryKey bool
+	NotNull    bool
+	// Collation is the default collating sequence of the column,
+	// e.g. "NOCASE".
+	Collation string
+}
+
+// VTabSchema describes the schema of a virtual table, declared with
+// Declare instead of a hand-written CREATE TABLE statement:
+//
+//	schema := &sqlite3.VTabSchema{Columns: []sqlite3.SchemaColumn{
+//		{Name: "id", Type: "TEXT", PrimaryKey: true},
+//		{Name: "stars", Type: "INTEGER"},
+//		{Name: "owner", Type: "TEXT", Hidden: true},
+//	}, WithoutRowid: true}
+//	err := schema.Declare(c)
+//
+// A VTab embedding *VTabSchema implements VTabColumnAffinity, so Filter
+// arguments are coerced to the types of their columns.
+type VTabSchema struct {
+	Columns []SchemaColumn
+	// WithoutRowid declares a WITHOUT ROWID table, which needs a
+	// single-column primary key. See VTabCursorRowid.
+	WithoutRowid bool
+}
+
+// Validate checks that the schema can be declared.
+func (s *VTabSchema) Validate() error {
+	if len(s.Columns) == 0 {
+		return errors.New("sqlite3: virtual table schema without columns")
+	}
+	for i, c := range s.Columns {
+		if c.Name == "" {
+			return fmt.Errorf("sqlite3: virtual table column %d has no name", i)
+		}
+		if j := s.Index(c.Name); j != i {
+			return fmt.Errorf("sqlite3: duplicate virtual table column %s", c.Name)
+		}
+		if !validDeclType(c.Type) {
+			return fmt.Errorf("sqlite3: invalid type %q for virtual table column %s", c.Type, c.Name)
+		}
+	}
+	if s.WithoutRowid && len(s.primaryKey()) != 1 {
+		return errors.New("sqlite3: WITHOUT ROWID virtual table needs a single-column primary key")
+	}
+	return nil
+}
+
+// validDeclType reports whether t can be used as is as a column type,
+// such as "UNSIGNED BIG INT" or "DECIMAL(10, 5)".
+func validDeclType(t string) bool {
+	// the arguments cannot end the type, nor the column definition
+	depth := 0
+	for _, r := range t {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(" _+-.", r):
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 1:
+		default:
+			return false
+		}
+		if depth < 0 || depth > 1 {
+			return false
+		}
+	}
+	return depth == 0 && !strings.Contains(t, "--") && !strings.Contains(strings.ToUpper(" "+t+" "), " HIDDEN ")
+}
+
+// quoteIdentifier quotes name as a SQL identifier.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// String returns the CREATE TABLE statement of the schema.
+func (s *VTabSchema) String() string {
+	var b strings.Builder
+	var pk []string
+	b.WriteString("CREATE TABLE x(")
+	for i, c := range s.Columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(quoteIdentifier(c.Name))
+		if c.Type != "" {
+			b.WriteString(" " + c.Type)
+		}
+		// SQLite looks for HIDDEN in the type of the column
+		if c.Hidden {
+			b.WriteString(" HIDDEN")
+		}
+		if c.NotNull {
+			b.WriteString(" NOT NULL")
+		}
+		if c.Collation != "" {
+			b.WriteString(" COLLATE " + quoteIdentifier(c.Collation))
+		}
+		if c.PrimaryKey {
+			pk = append(pk, quoteIdentifier(c.Name))
+		}
+	}
+	if len(pk) > 0 {
+		b.WriteString(", PRIMARY KEY(" + strings.Join(pk, ", ") + ")")
+	}
+	b.WriteString(")")
+	if s.WithoutRowid {
+		b.WriteString(" WITHOUT ROWID")
+	}
+	return b.String()
+}
+
+// Declare validates the schema and declares it as the schema of the
+// virtual table being created or connected. It must be called from
+// Module.Create or Module.Connect.
+func (s *VTabSchema) Declare(c *SQLiteConn) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	return c.DeclareVTab(s.String())
+}
+
+// primaryKey returns the indexes of the PRIMARY KEY columns.
+func (s *VTabSchema) primaryKey() []int {
+	var pk []int
+	for i, c := range s.Columns {
+		if c.PrimaryKey {
+			pk = append(pk, i)
+		}
+	}
+	return pk
+}
+
+// Index returns the index of the column named name, compared
+// case-insensitively as SQLite does, or -1.
+func (s *VTabSchema) Index(name string) int {
+	for i, c := range s.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ColumnAffinity returns the affinity of the column at index col.
+func (s *VTabSchema) ColumnAffinity(col int) Affinity {
+	if col < 0 || col >= len(s.Columns) {
+		return AffinityBlob
+	}
+	return TypeAffinity(s.Columns[col].Type)
+}
+
+// Coerce converts v the way SQLite would before storing it in the column
+// at index col of a regular table. Go integers, floats and booleans are
+// first converted to int64 and float64.
+func (s *VTabSchema) Coerce(col int, v any) any {
+	switch x := v.(type) {
+	case int:
+		v = int64(x)
+	case int32:
+		v = int64(x)
+	case bool:
+		if x {
+			v = int64(1)
+		} else {
+			v = int64(0)
+		}
+	case float32:
+		v = float64(x)
+	}
+	return s.ColumnAffinity(col).Apply(v)
+}
+
+// Result sets v, coerced to the type of the column at index col, as the
+// result of VTabCursor.Column.
+func (s *VTabSchema) Result(c *SQLiteContext, col int, v any) error {
+	switch x := s.Coerce(col, v).(type) {
+	case nil:
+		c.ResultNull()
+	case int64:
+		c.ResultInt64(x)
+	case float64:
+		c.ResultDouble(x)
+	case string:
+		c.ResultText(x)
+	case []byte:
+		c.ResultBlob(x)
+	default:
+		return fmt.Errorf("unsupported type %T for column %d", v, col)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+var testVTabSchema = &VTabSchema{
+	Columns: []SchemaColumn{
+		{Name: "id", Type: "TEXT", PrimaryKey: true, NotNull: true},
+		{Name: "stars", Type: "INTEGER"},
+		{Name: "full name", Type: "VARCHAR(255)", Collation: "NOCASE"},
+		{Name: `the "owner"`, Type: "TEXT", Hidden: true},
+		{Name: "data"},
+	},
+	WithoutRowid: true,
+}
+
+func TestVTabSchemaString(t *testing.T) {
+	want := `CREATE TABLE x("id" TEXT NOT NULL, "stars" INTEGER, "full name" VARCHAR(255) COLLATE "NOCASE", "the ""owner""" TEXT HIDDEN, "data", PRIMARY KEY("id")) WITHOUT ROWID`
+	if got := testVTabSchema.String(); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+	if err := testVTabSchema.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if i := testVTabSchema.Index("FULL NAME"); i != 2 {
+		t.Fatalf("expected column 2, got %d", i)
+	}
+	if i := testVTabSchema.Index("missing"); i != -1 {
+		t.Fatalf("expected no column, got %d", i)
+	}
+	if v := testVTabSchema.Coerce(1, "12"); v != int64(12) {
+		t.Fatalf("expected text to be coerced to an integer, got %#v", v)
+	}
+	if v := testVTabSchema.Coerce(0, 12); v != "12" {
+		t.Fatalf("expected an integer to be coerced to text, got %#v", v)
+	}
+}
+
+func TestVTabSchemaValidate(t *testing.T) {
+	for _, s := range []*VTabSchema{
+		{},
+		{Columns: []SchemaColumn{{Name: ""}}},
+		{Columns: []SchemaColumn{{Name: "a"}, {Name: "A"}}},
+		{Columns: []SchemaColumn{{Name: "a", Type: "INT); DROP TABLE t; --"}}},
+		{Columns: []SchemaColumn{{Name: "a", Type: "INT HIDDEN"}}},
+		{Columns: []SchemaColumn{{Name: "a", Type: "INT, b"}}},
+		{Columns: []SchemaColumn{{Name: "a", Type: "INT) --"}}},
+		{Columns: []SchemaColumn{{Name: "a"}}, WithoutRowid: true},
+		{Columns: []SchemaColumn{{Name: "a", PrimaryKey: true}, {Name: "b", PrimaryKey: true}}, WithoutRowid: true},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("expected an error validating %s", s)
+		}
+	}
+}
+
+type vtabSchemaModule struct{}
+
+func (m *vtabSchemaModule) EponymousOnlyModule() {}
+
+func (m *vtabSchemaModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	if err := testVTabSchema.Declare(c); err != nil {
+		return nil, err
+	}
+	return &vtabSchemaTable{testVTabSchema}, nil
+}
+
+func (m *vtabSchemaModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabSchemaModule) DestroyModule() {}
+
+type vtabSchemaTable struct {
+	*VTabSchema
+}
+
+func (v *vtabSchemaTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabSchemaTable) Disconnect() error { return nil }
+
+func (v *vtabSchemaTable) Destroy() error { return nil }
+
+func (v *vtabSchemaTable) Open() (VTabCursor, error) {
+	return &vtabSchemaCursor{t: v}, nil
+}
+
+type vtabSchemaCursor struct {
+	t   *vtabSchemaTable
+	eof bool
+}
+
+func (vc *vtabSchemaCursor) Close() error { return nil }
+
+func (vc *vtabSchemaCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.eof = false
+	return nil
+}
+
+func (vc *vtabSchemaCursor) Next() error {
+	vc.eof = true
+	return nil
+}
+
+func (vc *vtabSchemaCursor) EOF() bool { return vc.eof }
+
+func (vc *vtabSchemaCursor) Column(c *SQLiteContext, col int) error {
+	row := []any{42, "7", "Mattn", "mattn", []byte("x")}
+	return vc.t.Result(c, col, row[col])
+}
+
+func TestVTabSchemaModule(t *testing.T) {
+	sql.Register("sqlite3_TestVTabSchemaModule", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("repos", &vtabSchemaModule{})
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabSchemaModule", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	var id, stars, data string
+	err = db.QueryRow(`SELECT typeof(id) || id, typeof(stars), typeof(data) FROM repos WHERE "full name" = 'mattn'`).Scan(&id, &stars, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "text42" || stars != "integer" || data != "blob" {
+		t.Fatalf("unexpected column types %s %s %s", id, stars, data)
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM pragma_table_xinfo('repos') WHERE hidden = 1 AND name = 'the "owner"'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("expected the owner column to be hidden")
+	}
+}
+
+// vtabSchemaWritableModule declares schema, and its tables are writable.
+type vtabSchemaWritableModule struct {
+	schema *VTabSchema
+}
+
+func (m *vtabSchemaWritableModule) EponymousOnlyModule() {}
+
+func (m *vtabSchemaWritableModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	if err := m.schema.Declare(c); err != nil {
+		return nil, err
+	}
+	return &vtabSchemaWritableTable{vtabSchemaTable{m.schema}}, nil
+}
+
+func (m *vtabSchemaWritableModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabSchemaWritableModule) DestroyModule() {}
+
+type vtabSchemaWritableTable struct {
+	vtabSchemaTable
+}
+
+func (v *vtabSchemaWritableTable) Delete(key any) error { return nil }
+
+func (v *vtabSchemaWritableTable) Insert(key any, vals []any) (int64, error) { return 0, nil }
+
+func (v *vtabSchemaWritableTable) Update(key any, vals []any) error { return nil }
+
+func (v *vtabSchemaWritableTable) PartialUpdate() bool { return false }
+
+func TestVTabSchemaWithoutRowid(t *testing.T) {
+	sql.Register("sqlite3_TestVTabSchemaWithoutRowid", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			err := conn.CreateModule("single", &vtabSchemaWritableModule{&VTabSchema{Columns: []SchemaColumn{
+				{Name: "a", PrimaryKey: true},
+				{Name: "b"},
+			}, WithoutRowid: true}})
+			if err != nil {
+				return err
+			}
+			return conn.CreateModule("composite", &vtabSchemaWritableModule{&VTabSchema{Columns: []SchemaColumn{
+				{Name: "a", PrimaryKey: true},
+				{Name: "b", PrimaryKey: true},
+			}, WithoutRowid: true}})
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabSchemaWithoutRowid", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM single WHERE a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("DELETE FROM composite WHERE a = 1")
+	if err == nil || !strings.Contains(err.Error(), "needs a single-column primary key") {
+		t.Fatalf("expected an error for a composite primary key, got %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SliceModule returns a read-only eponymous-only module whose table has
+// one row per element of rows, and one column per exported field of T,
+// a struct or a pointer to a struct:
+//
+//	type Repo struct {
+//		Owner string `sqlite:"owner,key"`
+//		Name  string `sqlite:"name"`
+//		Stars int    `sqlite:"stars"`
+//		cache string // unexported fields are ignored
+//		Extra any    `sqlite:"-"`
+//	}
+//
+//	m, err := sqlite3.SliceModule(repos)
+//	err = conn.CreateModule("repos", m)
+//
+// The tag of a field sets the name of its column, which defaults to the
+// name of the field, and "-" leaves the field out. Fields can be strings,
+// integers, floats, booleans, []byte, time.Time (stored as RFC 3339 text)
+// or pointers to those, nil pointers being NULL.
+//
+// The key option marks columns whose equality constraints, such as
+// owner = 'mattn', are pushed down: only the matching rows are returned.
+//
+// The rows are read at every scan, but changes to the length of the
+// slice after the call are not seen; use FuncModule for changing data.
+func SliceModule[T any](rows []T) (Module, error) {
+	return newStructModule[T](func(ctx context.Context, filter map[string]any) (structIter, error) {
+		i := 0
+		return func() (any, bool, error) {
+			if i >= len(rows) {
+				return nil, false, nil
+			}
+			i++
+			return rows[i-1], true, nil
+		}, nil
+	})
+}
+
+// FuncModule returns a read-only eponymous-only module whose rows are
+// returned by fn at every scan. filter holds the values of the equality
+// constraints on key columns, by column name, so that fn can fetch only
+// the matching rows. The rows returned by fn are filtered again anyway.
+// ctx is the context of the statement, see SQLiteConn.VTabContext.
+//
+// Columns are declared from the fields of T, see SliceModule.
+func FuncModule[T any](fn func(ctx context.Context, filter map[string]any) ([]T, error)) (Module, error) {
+	return newStructModule[T](func(ctx context.Context, filter map[string]any) (structIter, error) {
+		rows, err := fn(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		return func() (any, bool, error) {
+			if i >= len(rows) {
+				return nil, false, nil
+			}
+			i++
+			return rows[i-1], true, nil
+		}, nil
+	})
+}
+
+// ChanModule returns a read-only eponymous-only module whose rows are
+// received from the channel returned by fn at every scan, until it is
+// closed. filter holds the values of the equality constraints on key
+// columns, as for FuncModule. ctx is cancelled when the scan ends, even
+// early because of a LIMIT clause, after which fn should stop sending
+// and close the channel.
+//
+// Columns are declared from the fields of T, see SliceModule.
+func ChanModule[T any](fn func(ctx context.Context, filter map[string]any) <-chan T) (Module, error) {
+	return newStructModule[T](func(ctx context.Context, filter map[string]any) (structIter, error) {
+		ch := fn(ctx, filter)
+		return func() (any, bool, error) {
+			select {
+			case v, ok := <-ch:
+				return v, ok, nil
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}, nil
+	})
+}
+
+// structIter returns the next row of a scan, and false at the end.
+type structIter func() (row any, ok bool, err error)
+
+// structSource starts a scan of the rows matching filter.
+type structSource func(ctx context.Context, filter map[string]any) (structIter, error)
+
+// structColumn is a column declared from a struct field.
+type structColumn struct {
+	name  string
+	index []int
+	key   bool
+	conv  func(reflect.Value) any
+}
+
+type structModule struct {
+	columns []structColumn
+	schema  *VTabSchema
+	source  structSource
+}
+
+func newStructModule[T any](source structSource) (Module, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("sqlite3: cannot declare columns from %s, a struct is expected", t)
+	}
+	m := &structModule{schema: &VTabSchema{}, source: source}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("sqlite"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		conv, typ, err := structFieldConv(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite3: field %s of %s: %v", f.Name, t, err)
+		}
+		col := structColumn{name: name, index: f.Index, conv: conv}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "key":
+				col.key = true
+			case "":
+			default:
+				return nil, fmt.Errorf("sqlite3: field %s of %s: unknown option %q", f.Name, t, opt)
+			}
+		}
+		m.columns = append(m.columns, col)
+		m.schema.Columns = append(m.schema.Columns, SchemaColumn{Name: name, Type: typ})
+	}
+	if err := m.schema.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// structFieldConv returns the conversion of the values of a field of type
+// t to the values of its column, and the declared type of the column.
+func structFieldConv(t reflect.Type) (func(reflect.Value) any, string, error) {
+	if t == timeType {
+		return func(v reflect.Value) any {
+			return v.Interface().(time.Time).Format(time.RFC3339Nano)
+		}, "TEXT", nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return func(v reflect.Value) any { return v.String() }, "TEXT", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) any { return v.Int() }, "INTEGER", nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(v reflect.Value) any {
+			if u := v.Uint(); u > math.MaxInt64 {
+				return float64(u)
+			}
+			return int64(v.Uint())
+		}, "INTEGER", nil
+	case reflect.Float32, reflect.Float64:
+		return func(v reflect.Value) any { return v.Float() }, "REAL", nil
+	case reflect.Bool:
+		return func(v reflect.Value) any { return v.Bool() }, "BOOLEAN", nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return func(v reflect.Value) any { return v.Bytes() }, "BLOB", nil
+		}
+	case reflect.Ptr:
+		conv, typ, err := structFieldConv(t.Elem())
+		if err != nil {
+			return nil, "", err
+		}
+		return func(v reflect.Value) any {
+			if v.IsNil() {
+				return nil
+			}
+			return conv(v.Elem())
+		}, typ, nil
+	}
+	return nil, "", fmt.Errorf("unsupported type %s", t)
+}
+
+func (m *structModule) EponymousOnlyModule() {}
+
+func (m *structModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	if err := m.schema.Declare(c); err != nil {
+		return nil, err
+	}
+	return &structTable{VTabSchema: m.schema, m: m, c: c}, nil
+}
+
+func (m *structModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *structModule) DestroyModule() {}
+
+type structTable struct {
+	*VTabSchema
+	m *structModule
+	c *SQLiteConn
+}
+
+func (v *structTable) BestIndex(csts []InfoConstraint, obs []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	res := &IndexResult{
+		Used:          make([]bool, len(csts)),
+		EstimatedCost: 1000000,
+		EstimatedRows: 1000000,
+	}
+	for i, c := range csts {
+		if !c.Usable || c.Op != OpEQ || c.Column < 0 || c.Column >= len(v.m.columns) || !v.m.columns[c.Column].key {
+			continue
+		}
+		// values are compared as with BINARY, so other collations are
+		// left to SQLite
+		if c.Collation != "" && !strings.EqualFold(c.Collation, "BINARY") {
+			continue
+		}
+		// SQLite checks the constraints again
+		res.Used[i] = true
+		res.EstimatedCost /= 100
+		res.EstimatedRows /= 100
+	}
+	return res, nil
+}
+
+func (v *structTable) Disconnect() error { return nil }
+
+func (v *structTable) Destroy() error { return nil }
+
+func (v *structTable) Open() (VTabCursor, error) {
+	return &structCursor{t: v}, nil
+}
+
+// structBatchSize is the number of rows of the batches of structCursor.
+const structBatchSize = 256
+
+type structCursor struct {
+	t      *structTable
+	filter map[string]any
+	keys   map[int]any
+	next   structIter
+	cancel context.CancelFunc
+}
+
+func (vc *structCursor) Close() error {
+	if vc.cancel != nil {
+		vc.cancel()
+	}
+	return nil
+}
+
+func (vc *structCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	return errors.New("sqlite3: struct cursor called without FilterArgs")
+}
+
+func (vc *structCursor) FilterArgs(idxNum int, idxStr string, args []FilterArg) error {
+	if vc.cancel != nil {
+		vc.cancel()
+	}
+	vc.filter = map[string]any{}
+	vc.keys = map[int]any{}
+	for _, a := range args {
+		vc.filter[vc.t.m.columns[a.Column].name] = a.Value
+		vc.keys[a.Column] = a.Value
+	}
+	ctx, cancel := context.WithCancel(vc.t.c.VTabContext())
+	vc.cancel = cancel
+	next, err := vc.t.m.source(ctx, vc.filter)
+	if err != nil {
+		return err
+	}
+	vc.next = next
+	return nil
+}
+
+func (vc *structCursor) NextBatch() ([][]any, error) {
+	var rows [][]any
+	for len(rows) < structBatchSize {
+		row, ok, err := vc.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		rv := reflect.ValueOf(row)
+		if rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				continue
+			}
+			rv = rv.Elem()
+		}
+		vals := make([]any, len(vc.t.m.columns))
+		for i, col := range vc.t.m.columns {
+			vals[i] = col.conv(rv.FieldByIndex(col.index))
+		}
+		if vc.matches(vals) {
+			rows = append(rows, vals)
+		}
+	}
+	return rows, nil
+}
+
+// matches reports whether vals satisfies the equality constraints on the
+// key columns.
+func (vc *structCursor) matches(vals []any) bool {
+	for col, want := range vc.keys {
+		if !structValueEqual(vc.t.Coerce(col, vals[col]), want) {
+			return false
+		}
+	}
+	return true
+}
+
+func structValueEqual(a, b any) bool {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x == y
+		case float64:
+			return float64(x) == y
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x == float64(y)
+		case float64:
+			return x == y
+		}
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case []byte:
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	return false
+}
+
+func (vc *structCursor) Next() error { return nil }
+
+func (vc *structCursor) EOF() bool { return true }
+
+func (vc *structCursor) Column(c *SQLiteContext, col int) error { return nil }
+
+func (vc *structCursor) Rowid() (int64, error) { return 0, nil }
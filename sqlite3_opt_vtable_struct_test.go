@@ -0,0 +1,173 @@
+// Copyright (C) 2019 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (sqlite_vtable || vtable) && cgo
+// +build sqlite_vtable vtable
+// +build cgo
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type structRepo struct {
+	Owner   string `sqlite:"owner,key"`
+	Name    string `sqlite:"name"`
+	Stars   int    `sqlite:"stars,key"`
+	Private bool
+	Topics  *string
+	Created time.Time `sqlite:"created"`
+	cache   string
+	Extra   any `sqlite:"-"`
+}
+
+func TestStructModules(t *testing.T) {
+	go1 := "go"
+	created := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	repos := []structRepo{
+		{Owner: "mattn", Name: "go-sqlite3", Stars: 8000, Topics: &go1, Created: created},
+		{Owner: "mattn", Name: "gom", Stars: 100, Private: true},
+		{Owner: "julien040", Name: "anyquery", Stars: 1000},
+	}
+	var filters []map[string]any
+	closed := make(chan struct{}, 1)
+
+	slice, err := SliceModule(repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := FuncModule(func(ctx context.Context, filter map[string]any) ([]*structRepo, error) {
+		filters = append(filters, filter)
+		return []*structRepo{&repos[0], nil, &repos[2]}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := ChanModule(func(ctx context.Context, filter map[string]any) <-chan structRepo {
+		c := make(chan structRepo)
+		go func() {
+			defer close(c)
+			defer func() { closed <- struct{}{} }()
+			for i := 0; ; i++ {
+				select {
+				case c <- structRepo{Owner: "gen", Stars: i}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return c
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql.Register("sqlite3_TestStructModules", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			if err := conn.CreateModule("repos", slice); err != nil {
+				return err
+			}
+			if err := conn.CreateModule("repos_func", fn); err != nil {
+				return err
+			}
+			return conn.CreateModule("repos_chan", ch)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestStructModules", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	query := func(q string, args ...any) []string {
+		t.Helper()
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		defer rows.Close()
+		var res []string
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, s)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return res
+	}
+
+	got := query("SELECT owner || '/' || name || ':' || stars || ':' || Private || ':' || ifnull(Topics, '-') || ':' || created FROM repos")
+	want := []string{
+		"mattn/go-sqlite3:8000:0:go:2014-01-02T03:04:05Z",
+		"mattn/gom:100:1:-:0001-01-01T00:00:00Z",
+		"julien040/anyquery:1000:0:-:0001-01-01T00:00:00Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if got := query("SELECT name FROM repos WHERE owner = ? AND stars = '100'", "mattn"); !reflect.DeepEqual(got, []string{"gom"}) {
+		t.Fatalf("unexpected rows for key constraints: %q", got)
+	}
+	if got := query("SELECT name FROM repos WHERE owner = 'MATTN' COLLATE NOCASE AND stars = 100"); !reflect.DeepEqual(got, []string{"gom"}) {
+		t.Fatalf("unexpected rows for a key constraint with a collation: %q", got)
+	}
+	if got := query("SELECT name FROM repos WHERE name = 'anyquery'"); !reflect.DeepEqual(got, []string{"anyquery"}) {
+		t.Fatalf("unexpected rows for a constraint on a regular column: %q", got)
+	}
+
+	if got := query("SELECT name FROM repos_func WHERE owner = 'mattn'"); !reflect.DeepEqual(got, []string{"go-sqlite3"}) {
+		t.Fatalf("unexpected rows for the func module: %q", got)
+	}
+	if len(filters) != 1 || !reflect.DeepEqual(filters[0], map[string]any{"owner": "mattn"}) {
+		t.Fatalf("unexpected filters %v", filters)
+	}
+
+	// the producer runs until the end of the scan, across batches
+	if got := query("SELECT count(*) FROM (SELECT stars FROM repos_chan LIMIT 1000)"); !reflect.DeepEqual(got, []string{"1000"}) {
+		t.Fatalf("unexpected row count for the chan module: %q", got)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the channel producer to stop at the end of the scan")
+	}
+	if got := query("SELECT stars FROM repos_chan LIMIT 3"); !reflect.DeepEqual(got, []string{"0", "1", "2"}) {
+		t.Fatalf("unexpected rows for the chan module: %q", got)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the channel producer to stop at the end of the scan")
+	}
+}
+
+func TestStructModuleErrors(t *testing.T) {
+	if _, err := SliceModule([]int{1}); err == nil || !strings.Contains(err.Error(), "a struct is expected") {
+		t.Fatalf("expected an error for a non-struct type, got %v", err)
+	}
+	type unsupported struct {
+		M map[string]int
+	}
+	if _, err := SliceModule([]unsupported{}); err == nil || !strings.Contains(err.Error(), "unsupported type map[string]int") {
+		t.Fatalf("expected an error for an unsupported field, got %v", err)
+	}
+	type badOption struct {
+		A int `sqlite:"a,primary"`
+	}
+	if _, err := SliceModule([]badOption{}); err == nil || !strings.Contains(err.Error(), `unknown option "primary"`) {
+		t.Fatalf("expected an error for an unknown option, got %v", err)
+	}
+}
@@ -9,13 +9,16 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 type testModule struct {
@@ -67,7 +70,7 @@ func (m testModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
 
 func (m testModule) DestroyModule() {}
 
-func (v *testVTab) BestIndex(cst []InfoConstraint, ob []InfoOrderBy) (*IndexResult, error) {
+func (v *testVTab) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
 	used := make([]bool, 0, len(cst))
 	for range cst {
 		used = append(used, false)
@@ -377,7 +380,7 @@ func (t *vtabUpdateTable) Open() (VTabCursor, error) {
 	return &vtabUpdateCursor{t, 0}, nil
 }
 
-func (t *vtabUpdateTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy) (*IndexResult, error) {
+func (t *vtabUpdateTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
 	return &IndexResult{Used: make([]bool, len(cst))}, nil
 }
 
@@ -422,6 +425,10 @@ func (t *vtabUpdateTable) Update(id any, vals []any) error {
 	return nil
 }
 
+func (t *vtabUpdateTable) PartialUpdate() bool {
+	return false
+}
+
 func (t *vtabUpdateTable) Delete(id any) error {
 	i, ok := id.(int64)
 	if !ok {
@@ -516,7 +523,7 @@ func (m testModuleEponymousOnly) Connect(c *SQLiteConn, args []string) (VTab, er
 
 func (m testModuleEponymousOnly) DestroyModule() {}
 
-func (v *testVTabEponymousOnly) BestIndex(cst []InfoConstraint, ob []InfoOrderBy) (*IndexResult, error) {
+func (v *testVTabEponymousOnly) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
 	used := make([]bool, 0, len(cst))
 	for range cst {
 		used = append(used, false)
@@ -607,3 +614,2263 @@ func TestCreateModuleEponymousOnly(t *testing.T) {
 		t.Logf("couldn't drop virtual table: %v", err)
 	}
 }
+
+type vtabRHSModule struct {
+	csts []InfoConstraint
+}
+
+func (m *vtabRHSModule) EponymousOnlyModule() {}
+
+func (m *vtabRHSModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(repo TEXT, stars INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabRHSTable{m}, nil
+}
+
+func (m *vtabRHSModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabRHSModule) DestroyModule() {}
+
+type vtabRHSTable struct {
+	m *vtabRHSModule
+}
+
+func (v *vtabRHSTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	v.m.csts = append(v.m.csts, cst...)
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabRHSTable) Disconnect() error { return nil }
+
+func (v *vtabRHSTable) Destroy() error { return nil }
+
+func (v *vtabRHSTable) Open() (VTabCursor, error) {
+	return &testVTabCursor{&testVTab{}, 0}, nil
+}
+
+func TestVTabRHSValue(t *testing.T) {
+	m := &vtabRHSModule{}
+	sql.Register("sqlite3_TestVTabRHSValue", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("rhs", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabRHSValue", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT * FROM rhs WHERE repo = 'go-sqlite3' AND stars > 10")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	rows.Close()
+
+	var repo, stars bool
+	for _, c := range m.csts {
+		switch {
+		case c.Column == 0 && c.Op == OpEQ:
+			if !c.HasRHS || c.RHS != "go-sqlite3" {
+				t.Fatalf("expected RHS 'go-sqlite3' for repo, got %v (%v)", c.RHS, c.HasRHS)
+			}
+			repo = true
+		case c.Column == 1 && c.Op == OpGT:
+			if !c.HasRHS || c.RHS != int64(10) {
+				t.Fatalf("expected RHS 10 for stars, got %v (%v)", c.RHS, c.HasRHS)
+			}
+			stars = true
+		}
+	}
+	if !repo || !stars {
+		t.Fatalf("expected constraints on repo and stars, got %v", m.csts)
+	}
+}
+
+type vtabInModule struct {
+	filters [][]any
+}
+
+func (m *vtabInModule) EponymousOnlyModule() {}
+
+func (m *vtabInModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(id INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabInTable{m}, nil
+}
+
+func (m *vtabInModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabInModule) DestroyModule() {}
+
+type vtabInTable struct {
+	m *vtabInModule
+}
+
+func (v *vtabInTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	used := make([]bool, len(cst))
+	in := make([]bool, len(cst))
+	for i, c := range cst {
+		if c.Usable && c.Column == 0 && c.Op == OpEQ {
+			used[i] = true
+			in[i] = c.In
+			break
+		}
+	}
+	return &IndexResult{Used: used, In: in}, nil
+}
+
+func (v *vtabInTable) Disconnect() error { return nil }
+
+func (v *vtabInTable) Destroy() error { return nil }
+
+func (v *vtabInTable) Open() (VTabCursor, error) {
+	return &vtabInCursor{m: v.m}, nil
+}
+
+type vtabInCursor struct {
+	m     *vtabInModule
+	ids   []any
+	index int
+}
+
+func (vc *vtabInCursor) Close() error { return nil }
+
+func (vc *vtabInCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.m.filters = append(vc.m.filters, vals)
+	vc.ids, vc.index = nil, 0
+	if len(vals) == 1 {
+		if in, ok := vals[0].([]any); ok {
+			vc.ids = in
+		} else {
+			vc.ids = vals
+		}
+	}
+	return nil
+}
+
+func (vc *vtabInCursor) Next() error {
+	vc.index++
+	return nil
+}
+
+func (vc *vtabInCursor) EOF() bool {
+	return vc.index >= len(vc.ids)
+}
+
+func (vc *vtabInCursor) Column(c *SQLiteContext, col int) error {
+	c.ResultInt64(vc.ids[vc.index].(int64))
+	return nil
+}
+
+func (vc *vtabInCursor) Rowid() (int64, error) {
+	return int64(vc.index), nil
+}
+
+func TestVTabInBatch(t *testing.T) {
+	m := &vtabInModule{}
+	sql.Register("sqlite3_TestVTabInBatch", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("inbatch", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabInBatch", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id FROM inbatch WHERE id IN (1, 2, 3)")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if len(m.filters) != 1 {
+		t.Fatalf("expected exactly one Filter call, got %d: %v", len(m.filters), m.filters)
+	}
+	if !reflect.DeepEqual(m.filters[0], []any{[]any{int64(1), int64(2), int64(3)}}) {
+		t.Fatalf("expected IN list as a single argument, got %v", m.filters[0])
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 2, 3}) {
+		t.Fatalf("expected ids [1 2 3], got %v", ids)
+	}
+}
+
+// vtabPlanModule is an eponymous-only module whose planning is driven by
+// the test, and which records what BestIndex and Filter received.
+type vtabPlanModule struct {
+	schema    string
+	rows      []int64
+	bestIndex func(cst []InfoConstraint) *IndexResult
+	csts      [][]InfoConstraint
+	infos     []IndexInformation
+	filters   [][]any
+
+	// argFilter makes cursors implement VTabCursorArgFilter
+	argFilter  bool
+	affinities []Affinity
+	filterArgs [][]FilterArg
+
+	// findFunction implements VTabFunctionOverloader
+	findFunction func(nArg int, name string) (any, Op)
+}
+
+func (m *vtabPlanModule) EponymousOnlyModule() {}
+
+func (m *vtabPlanModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab(m.schema)
+	if err != nil {
+		return nil, err
+	}
+	return &vtabPlanTable{m}, nil
+}
+
+func (m *vtabPlanModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabPlanModule) DestroyModule() {}
+
+type vtabPlanTable struct {
+	m *vtabPlanModule
+}
+
+func (v *vtabPlanTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	v.m.csts = append(v.m.csts, cst)
+	v.m.infos = append(v.m.infos, info)
+	if v.m.bestIndex != nil {
+		return v.m.bestIndex(cst), nil
+	}
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabPlanTable) Disconnect() error { return nil }
+
+func (v *vtabPlanTable) Destroy() error { return nil }
+
+func (v *vtabPlanTable) Open() (VTabCursor, error) {
+	if v.m.argFilter {
+		return &vtabPlanArgCursor{vtabPlanCursor{m: v.m}}, nil
+	}
+	return &vtabPlanCursor{m: v.m}, nil
+}
+
+func (v *vtabPlanTable) FindFunction(nArg int, name string) (any, Op) {
+	if v.m.findFunction != nil {
+		return v.m.findFunction(nArg, name)
+	}
+	return nil, 0
+}
+
+func (v *vtabPlanTable) ColumnAffinity(col int) Affinity {
+	if col < len(v.m.affinities) {
+		return v.m.affinities[col]
+	}
+	return AffinityBlob
+}
+
+type vtabPlanCursor struct {
+	m     *vtabPlanModule
+	index int
+}
+
+func (vc *vtabPlanCursor) Close() error { return nil }
+
+func (vc *vtabPlanCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.m.filters = append(vc.m.filters, vals)
+	vc.index = 0
+	return nil
+}
+
+func (vc *vtabPlanCursor) Next() error {
+	vc.index++
+	return nil
+}
+
+func (vc *vtabPlanCursor) EOF() bool { return vc.index >= len(vc.m.rows) }
+
+func (vc *vtabPlanCursor) Column(c *SQLiteContext, col int) error {
+	c.ResultInt64(vc.m.rows[vc.index])
+	return nil
+}
+
+func (vc *vtabPlanCursor) Rowid() (int64, error) { return int64(vc.index), nil }
+
+type vtabPlanArgCursor struct {
+	vtabPlanCursor
+}
+
+func (vc *vtabPlanArgCursor) FilterArgs(idxNum int, idxStr string, args []FilterArg) error {
+	vc.m.filterArgs = append(vc.m.filterArgs, args)
+	vc.index = 0
+	return nil
+}
+
+func openVTabPlanDB(t *testing.T, name string, m *vtabPlanModule) *sql.DB {
+	sql.Register("sqlite3_"+name, &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("plan", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_"+name, ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestVTabIndexInformation(t *testing.T) {
+	m := &vtabPlanModule{
+		schema: "CREATE TABLE x(a INT, b INT, c TEXT)",
+		bestIndex: func(cst []InfoConstraint) *IndexResult {
+			used := make([]bool, len(cst))
+			for i, c := range cst {
+				used[i] = c.Usable
+			}
+			return &IndexResult{Used: used, ScanUnique: true}
+		},
+	}
+	db := openVTabPlanDB(t, "TestVTabIndexInformation", m)
+	defer db.Close()
+
+	_, err := db.Exec("SELECT DISTINCT a FROM plan WHERE a IS NULL AND b != 3 AND c = 'x' COLLATE NOCASE")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+
+	ops := map[Op]InfoConstraint{}
+	for _, c := range m.csts[len(m.csts)-1] {
+		ops[c.Op] = c
+	}
+	if c, ok := ops[OpISNULL]; !ok || c.Column != 0 || c.HasRHS {
+		t.Fatalf("expected an ISNULL constraint without RHS on a, got %v", m.csts)
+	}
+	if c, ok := ops[OpNE]; !ok || c.Column != 1 || c.RHS != int64(3) {
+		t.Fatalf("expected a NE constraint on b, got %v", m.csts)
+	}
+	if c, ok := ops[OpEQ]; !ok || c.Column != 2 || c.Collation != "NOCASE" {
+		t.Fatalf("expected an EQ constraint on c with NOCASE collation, got %v", m.csts)
+	}
+
+	info := m.infos[len(m.infos)-1]
+	if info.Distinct == 0 {
+		t.Fatalf("expected DISTINCT to be reported, got %d", info.Distinct)
+	}
+	if !info.ColumnUsed(0) || !info.ColumnUsed(1) || !info.ColumnUsed(2) {
+		t.Fatalf("expected all columns to be used, got %064b", info.ColUsed)
+	}
+
+	if len(m.filters) != 1 {
+		t.Fatalf("expected exactly one Filter call, got %d", len(m.filters))
+	}
+	var nils int
+	for _, v := range m.filters[0] {
+		if v == nil {
+			nils++
+		}
+	}
+	if len(m.filters[0]) != 3 || nils != 1 {
+		t.Fatalf("expected 3 arguments with a nil one for IS NULL, got %#v", m.filters[0])
+	}
+}
+
+func TestVTabColumnUsedWide(t *testing.T) {
+	cols := make([]string, 70)
+	for i := range cols {
+		cols[i] = fmt.Sprintf("c%d", i)
+	}
+	m := &vtabPlanModule{schema: "CREATE TABLE x(" + strings.Join(cols, ", ") + ")"}
+	db := openVTabPlanDB(t, "TestVTabColumnUsedWide", m)
+	defer db.Close()
+
+	_, err := db.Exec("SELECT c1, c65 FROM plan")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	info := m.infos[len(m.infos)-1]
+	if info.ColumnUsed(0) || !info.ColumnUsed(1) || info.ColumnUsed(2) {
+		t.Fatalf("unexpected columns used: %064b", info.ColUsed)
+	}
+	if !info.ColumnUsed(65) || !info.ColumnUsed(69) {
+		t.Fatalf("expected columns past 63 to be reported as used: %064b", info.ColUsed)
+	}
+	if info.ColumnUsed(-1) {
+		t.Fatal("negative column index reported as used")
+	}
+}
+
+func TestVTabOmit(t *testing.T) {
+	var omit bool
+	m := &vtabPlanModule{
+		schema: "CREATE TABLE x(a INT)",
+		rows:   []int64{1, 2, 3},
+		bestIndex: func(cst []InfoConstraint) *IndexResult {
+			used := make([]bool, len(cst))
+			omits := make([]bool, len(cst))
+			for i, c := range cst {
+				used[i] = c.Usable
+				omits[i] = c.Usable && omit
+			}
+			return &IndexResult{Used: used, Omit: omits}
+		},
+	}
+	db := openVTabPlanDB(t, "TestVTabOmit", m)
+	defer db.Close()
+
+	for _, tt := range []struct {
+		omit bool
+		want int
+	}{
+		{false, 1},
+		{true, 3},
+	} {
+		omit = tt.omit
+		rows, err := db.Query("SELECT a FROM plan WHERE a = 2")
+		if err != nil {
+			t.Fatalf("couldn't select from virtual table: %v", err)
+		}
+		n, _ := getRowCount(rows)
+		rows.Close()
+		// The cursor ignores constraints, so rows only get filtered
+		// when SQLite evaluates the constraint itself.
+		if n != tt.want {
+			t.Fatalf("omit=%v: expected %d rows, got %d", tt.omit, tt.want, n)
+		}
+	}
+}
+
+func TestVTabFilterArgs(t *testing.T) {
+	m := &vtabPlanModule{
+		schema:     "CREATE TABLE x(a INT, b TEXT, c)",
+		argFilter:  true,
+		affinities: []Affinity{AffinityInteger, AffinityText, AffinityBlob},
+	}
+	// the arguments of the usable constraints, in reverse order, to check
+	// that they follow ArgvIndex rather than the order of the constraints
+	var order []FilterArg
+	m.bestIndex = func(cst []InfoConstraint) *IndexResult {
+		res := &IndexResult{Used: make([]bool, len(cst)), ArgvIndex: make([]int, len(cst))}
+		order = order[:0]
+		for i := len(cst) - 1; i >= 0; i-- {
+			if cst[i].Usable {
+				res.Used[i] = true
+				order = append(order, FilterArg{Column: cst[i].Column, Op: cst[i].Op})
+				res.ArgvIndex[i] = len(order)
+			}
+		}
+		return res
+	}
+	db := openVTabPlanDB(t, "TestVTabFilterArgs", m)
+	defer db.Close()
+
+	_, err := db.Exec("SELECT * FROM plan WHERE a = '42' AND b > 7 AND c IS NULL AND c IS NOT ?", nil)
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	if len(m.filters) != 0 {
+		t.Fatalf("expected FilterArgs to be called instead of Filter, got %v", m.filters)
+	}
+	if len(m.filterArgs) != 1 {
+		t.Fatalf("expected exactly one FilterArgs call, got %d", len(m.filterArgs))
+	}
+
+	byOp := map[Op]FilterArg{}
+	for i, a := range m.filterArgs[0] {
+		if i >= len(order) || a.Column != order[i].Column || a.Op != order[i].Op {
+			t.Fatalf("expected the arguments in the order %v, got %v", order, m.filterArgs[0])
+		}
+		byOp[a.Op] = a
+	}
+	want := map[Op]FilterArg{
+		OpEQ:     {Column: 0, Op: OpEQ, Value: int64(42)},
+		OpGT:     {Column: 1, Op: OpGT, Value: "7"},
+		OpISNULL: {Column: 2, Op: OpISNULL, Value: nil},
+		OpISNOT:  {Column: 2, Op: OpISNOT, Value: nil},
+	}
+	if !reflect.DeepEqual(byOp, want) {
+		t.Fatalf("unexpected filter arguments:\n got: %#v\nwant: %#v", byOp, want)
+	}
+
+	m.bestIndex = func(cst []InfoConstraint) *IndexResult {
+		res := &IndexResult{Used: make([]bool, len(cst)), ArgvIndex: make([]int, len(cst))}
+		for i := range cst {
+			res.Used[i] = cst[i].Usable
+			res.ArgvIndex[i] = 1
+		}
+		return res
+	}
+	_, err = db.Exec("SELECT * FROM plan WHERE a = 1 AND b = 2")
+	if err == nil || !strings.Contains(err.Error(), "ArgvIndex") {
+		t.Fatalf("expected an error for duplicate argument positions, got %v", err)
+	}
+}
+
+type vtabBatchModule struct {
+	batches [][][]any
+	calls   int
+	// closePanic makes the Close method of cursors panic
+	closePanic bool
+}
+
+func (m *vtabBatchModule) EponymousOnlyModule() {}
+
+func (m *vtabBatchModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(id INT, name TEXT, score REAL, data BLOB)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabBatchTable{m}, nil
+}
+
+func (m *vtabBatchModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabBatchModule) DestroyModule() {}
+
+type vtabBatchTable struct {
+	m *vtabBatchModule
+}
+
+func (v *vtabBatchTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabBatchTable) Disconnect() error { return nil }
+
+func (v *vtabBatchTable) Destroy() error { return nil }
+
+func (v *vtabBatchTable) Open() (VTabCursor, error) {
+	return &vtabBatchCursor{m: v.m}, nil
+}
+
+type vtabBatchCursor struct {
+	m     *vtabBatchModule
+	index int
+}
+
+func (vc *vtabBatchCursor) Close() error {
+	if vc.m.closePanic {
+		panic("bad close")
+	}
+	return nil
+}
+
+func (vc *vtabBatchCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.index = 0
+	return nil
+}
+
+func (vc *vtabBatchCursor) NextBatch() ([][]any, error) {
+	vc.m.calls++
+	if vc.index >= len(vc.m.batches) {
+		return nil, nil
+	}
+	vc.index++
+	return vc.m.batches[vc.index-1], nil
+}
+
+func (vc *vtabBatchCursor) Next() error { return errors.New("Next called on a batch cursor") }
+
+func (vc *vtabBatchCursor) EOF() bool { return true }
+
+func (vc *vtabBatchCursor) Column(c *SQLiteContext, col int) error {
+	return errors.New("Column called on a batch cursor")
+}
+
+func (vc *vtabBatchCursor) Rowid() (int64, error) {
+	return 0, errors.New("Rowid called on a batch cursor")
+}
+
+// vtabBatchWritableModule has writable tables, which cannot use batch
+// cursors.
+type vtabBatchWritableModule struct {
+	vtabBatchModule
+}
+
+func (m *vtabBatchWritableModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	v, err := m.vtabBatchModule.Create(c, args)
+	if err != nil {
+		return nil, err
+	}
+	return &vtabBatchWritableTable{v.(*vtabBatchTable)}, nil
+}
+
+func (m *vtabBatchWritableModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+type vtabBatchWritableTable struct {
+	*vtabBatchTable
+}
+
+func (v *vtabBatchWritableTable) Delete(any) error { return nil }
+
+func (v *vtabBatchWritableTable) Insert(any, []any) (int64, error) { return 0, nil }
+
+func (v *vtabBatchWritableTable) Update(any, []any) error { return nil }
+
+func (v *vtabBatchWritableTable) PartialUpdate() bool { return false }
+
+func TestVTabBatchCursor(t *testing.T) {
+	m := &vtabBatchModule{
+		batches: [][][]any{
+			{
+				{int64(1), "one", 1.5, []byte{1}},
+				{2, "", float32(2), []byte{}},
+			},
+			{
+				{int32(3), nil, nil, nil},
+				{true, "four"},
+			},
+		},
+	}
+	sql.Register("sqlite3_TestVTabBatchCursor", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			if err := conn.CreateModule("batch_writable", &vtabBatchWritableModule{}); err != nil {
+				return err
+			}
+			return conn.CreateModule("batch", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabBatchCursor", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT rowid, id, name, score, data FROM batch")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	var got [][]any
+	for rows.Next() {
+		var rowid, id int64
+		var name sql.NullString
+		var score sql.NullFloat64
+		var data []byte
+		if err := rows.Scan(&rowid, &id, &name, &score, &data); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, []any{rowid, id, name.String, name.Valid, score.Float64, data})
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	want := [][]any{
+		{int64(0), int64(1), "one", true, 1.5, []byte{1}},
+		{int64(1), int64(2), "", true, 2.0, []byte{}},
+		{int64(2), int64(3), "", false, 0.0, []byte(nil)},
+		{int64(3), int64(1), "four", true, 0.0, []byte(nil)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected rows:\n got: %#v\nwant: %#v", got, want)
+	}
+	if m.calls != 3 {
+		t.Fatalf("expected 3 NextBatch calls, got %d", m.calls)
+	}
+
+	m.batches = [][][]any{{{struct{}{}}}}
+	_, err = db.Exec("SELECT * FROM batch")
+	if err == nil || !strings.Contains(err.Error(), "unsupported type") {
+		t.Fatalf("expected an unsupported type error, got %v", err)
+	}
+
+	_, err = db.Exec("DELETE FROM batch_writable WHERE id = 1")
+	if err == nil || !strings.Contains(err.Error(), "cannot use a batch cursor as it is writable") {
+		t.Fatalf("expected batch cursors to be rejected on writable tables, got %v", err)
+	}
+
+	// a failed Close still frees the cursor and its batch
+	m.batches = [][][]any{{{1, "one", 1.5, []byte{1}}}}
+	m.closePanic = true
+	for i := 0; i < 3; i++ {
+		var id int64
+		if err := db.QueryRow("SELECT id FROM batch").Scan(&id); err != nil || id != 1 {
+			t.Fatalf("unexpected row %d %v", id, err)
+		}
+	}
+}
+
+type vtabContextKey struct{}
+
+type vtabContextModule struct {
+	filterValue any
+	cancelled   chan struct{}
+}
+
+func (m *vtabContextModule) EponymousOnlyModule() {}
+
+func (m *vtabContextModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(id INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabContextTable{m}, nil
+}
+
+func (m *vtabContextModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabContextModule) DestroyModule() {}
+
+type vtabContextTable struct {
+	m *vtabContextModule
+}
+
+func (v *vtabContextTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabContextTable) Disconnect() error { return nil }
+
+func (v *vtabContextTable) Destroy() error { return nil }
+
+func (v *vtabContextTable) Open() (VTabCursor, error) {
+	return &vtabContextCursor{m: v.m}, nil
+}
+
+type vtabContextCursor struct {
+	m     *vtabContextModule
+	index int
+}
+
+func (vc *vtabContextCursor) Close() error { return nil }
+
+func (vc *vtabContextCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	return errors.New("Filter called on a context cursor")
+}
+
+func (vc *vtabContextCursor) FilterContext(ctx context.Context, idxNum int, idxStr string, vals []any) error {
+	vc.m.filterValue = ctx.Value(vtabContextKey{})
+	vc.index = 0
+	return nil
+}
+
+func (vc *vtabContextCursor) Next() error {
+	return errors.New("Next called on a context cursor")
+}
+
+func (vc *vtabContextCursor) NextContext(ctx context.Context) error {
+	vc.index++
+	if vc.index < 2 {
+		return nil
+	}
+	// simulate a slow upstream call
+	select {
+	case <-ctx.Done():
+		close(vc.m.cancelled)
+		return ctx.Err()
+	case <-time.After(10 * time.Second):
+		return errors.New("context was not cancelled")
+	}
+}
+
+func (vc *vtabContextCursor) EOF() bool { return false }
+
+func (vc *vtabContextCursor) Column(c *SQLiteContext, col int) error {
+	c.ResultInt(vc.index)
+	return nil
+}
+
+func (vc *vtabContextCursor) Rowid() (int64, error) { return int64(vc.index), nil }
+
+func TestVTabCursorContext(t *testing.T) {
+	m := &vtabContextModule{cancelled: make(chan struct{})}
+	sql.Register("sqlite3_TestVTabCursorContext", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("slow", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabCursorContext", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.WithValue(context.Background(), vtabContextKey{}, "value")
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, "SELECT id FROM slow")
+	if err != nil {
+		t.Fatalf("couldn't select from virtual table: %v", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if !errors.Is(rows.Err(), context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", rows.Err())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("query took %v to be cancelled", elapsed)
+	}
+
+	select {
+	case <-m.cancelled:
+	default:
+		t.Fatal("expected the cursor context to be cancelled")
+	}
+	if m.filterValue != "value" {
+		t.Fatalf("expected Filter to receive the query context, got %v", m.filterValue)
+	}
+}
+
+// vtabCountModule returns the integers from 1 to n, and checks that the
+// context its cursors received in FilterContext is still alive in
+// NextContext.
+type vtabCountModule struct {
+	n    int
+	ctxs []context.Context
+	// eofPanic is the row at which EOF panics, if not 0
+	eofPanic int
+	// argFilter makes cursors implement VTabCursorArgFilterContext too
+	argFilter bool
+}
+
+func (m *vtabCountModule) EponymousOnlyModule() {}
+
+func (m *vtabCountModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(id INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabCountTable{m}, nil
+}
+
+func (m *vtabCountModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabCountModule) DestroyModule() {}
+
+type vtabCountTable struct {
+	m *vtabCountModule
+}
+
+func (v *vtabCountTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabCountTable) Disconnect() error { return nil }
+
+func (v *vtabCountTable) Destroy() error { return nil }
+
+func (v *vtabCountTable) Open() (VTabCursor, error) {
+	if v.m.argFilter {
+		return &vtabCountArgCursor{vtabCountCursor{m: v.m}}, nil
+	}
+	return &vtabCountCursor{m: v.m}, nil
+}
+
+type vtabCountCursor struct {
+	m     *vtabCountModule
+	ctx   context.Context
+	index int
+}
+
+func (vc *vtabCountCursor) Close() error { return nil }
+
+func (vc *vtabCountCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	return errors.New("Filter called on a context cursor")
+}
+
+func (vc *vtabCountCursor) FilterContext(ctx context.Context, idxNum int, idxStr string, vals []any) error {
+	vc.ctx = ctx
+	vc.m.ctxs = append(vc.m.ctxs, ctx)
+	vc.index = 1
+	return nil
+}
+
+func (vc *vtabCountCursor) Next() error {
+	return errors.New("Next called on a context cursor")
+}
+
+func (vc *vtabCountCursor) NextContext(ctx context.Context) error {
+	if err := vc.ctx.Err(); err != nil {
+		return fmt.Errorf("context of Filter done at row %d: %w", vc.index, err)
+	}
+	vc.index++
+	return nil
+}
+
+func (vc *vtabCountCursor) EOF() bool {
+	if vc.index == vc.m.eofPanic {
+		panic("bad cursor")
+	}
+	return vc.index > vc.m.n
+}
+
+func (vc *vtabCountCursor) Column(c *SQLiteContext, col int) error {
+	c.ResultInt(vc.index)
+	return nil
+}
+
+func (vc *vtabCountCursor) Rowid() (int64, error) { return int64(vc.index), nil }
+
+// vtabCountArgCursor receives structured arguments and contexts.
+type vtabCountArgCursor struct {
+	vtabCountCursor
+}
+
+func (vc *vtabCountArgCursor) FilterArgs(idxNum int, idxStr string, args []FilterArg) error {
+	return errors.New("FilterArgs called on a context cursor")
+}
+
+func (vc *vtabCountArgCursor) FilterArgsContext(ctx context.Context, idxNum int, idxStr string, args []FilterArg) error {
+	return vc.FilterContext(ctx, idxNum, idxStr, nil)
+}
+
+func TestVTabCursorContextLifetime(t *testing.T) {
+	m := &vtabCountModule{n: 5}
+	sql.Register("sqlite3_TestVTabCursorContextLifetime", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("count", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabCursorContextLifetime", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, argFilter := range []bool{false, true} {
+		m.argFilter = argFilter
+		for _, ctx := range []context.Context{context.Background(), ctx} {
+			m.ctxs = nil
+			rows, err := db.QueryContext(ctx, "SELECT id FROM count")
+			if err != nil {
+				t.Fatalf("couldn't select from virtual table: %v", err)
+			}
+			var n int
+			for rows.Next() {
+				if len(m.ctxs) != 1 || m.ctxs[0].Err() != nil {
+					t.Fatalf("expected the context to be alive until the rows are closed, got %v", m.ctxs)
+				}
+				n++
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatalf("argFilter=%v: %v", argFilter, err)
+			}
+			if n != m.n {
+				t.Fatalf("expected %d rows, got %d", m.n, n)
+			}
+			rows.Close()
+			if m.ctxs[0].Err() == nil {
+				t.Fatal("expected the context to be cancelled when the rows are closed")
+			}
+		}
+
+		m.ctxs = nil
+		if _, err := db.Exec("SELECT id FROM count"); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.ctxs) != 1 || m.ctxs[0].Err() == nil {
+			t.Fatal("expected the context to be cancelled when the execution completes")
+		}
+	}
+}
+
+func TestVTabPanic(t *testing.T) {
+	m := &vtabPlanModule{
+		schema: "CREATE TABLE x(a INT)",
+		rows:   []int64{1},
+		bestIndex: func(cst []InfoConstraint) *IndexResult {
+			if len(cst) > 0 {
+				panic("bad plan")
+			}
+			return &IndexResult{}
+		},
+	}
+	db := openVTabPlanDB(t, "TestVTabPanic", m)
+	defer db.Close()
+
+	var a int64
+	err := db.QueryRow("SELECT a FROM plan WHERE a = 1").Scan(&a)
+	if err == nil || !strings.Contains(err.Error(), "panic: bad plan") {
+		t.Fatalf("expected the panic of BestIndex as an error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "goroutine") {
+		t.Fatalf("unexpected stack trace in the error %q", err)
+	}
+	if err := db.QueryRow("SELECT a FROM plan").Scan(&a); err != nil || a != 1 {
+		t.Fatalf("expected the virtual table to remain usable, got %d %v", a, err)
+	}
+}
+
+func TestVTabPanicEOF(t *testing.T) {
+	m := &vtabCountModule{n: 5, eofPanic: 3}
+	sql.Register("sqlite3_TestVTabPanicEOF", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("count", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabPanicEOF", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	// EOF cannot fail, the panic must not end the scan silently
+	for _, q := range []string{"SELECT sum(id) FROM count", "SELECT count(*) FROM count", "SELECT rowid FROM count"} {
+		rows, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for rows.Next() {
+			n++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err == nil || !strings.Contains(err.Error(), "panic: bad cursor") {
+			t.Fatalf("%s: expected the panic of EOF as an error, got %d rows", q, n)
+		}
+	}
+}
+
+// vtabTxModule records the calls made to its tables, which implement
+// VTabTransaction.
+type vtabTxModule struct {
+	events   []string
+	syncErr  error
+	problems []string
+}
+
+func (m *vtabTxModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	m.events = append(m.events, "create")
+	err := c.DeclareVTab("CREATE TABLE x(a INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabTxTable{m}, nil
+}
+
+func (m *vtabTxModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	m.events = append(m.events, "connect")
+	err := c.DeclareVTab("CREATE TABLE x(a INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabTxTable{m}, nil
+}
+
+func (m *vtabTxModule) DestroyModule() {}
+
+// vtabEponymousOnlyTxModule is both eponymous-only and transactional.
+type vtabEponymousOnlyTxModule struct {
+	vtabTxModule
+}
+
+func (m *vtabEponymousOnlyTxModule) EponymousOnlyModule() {}
+
+func (m *vtabEponymousOnlyTxModule) TransactionModule() {}
+
+// vtabEponymousModule can be used both eponymously and with CREATE
+// VIRTUAL TABLE.
+type vtabEponymousModule struct {
+	vtabTxModule
+}
+
+func (m *vtabEponymousModule) EponymousModule() {}
+
+type vtabTxTable struct {
+	m *vtabTxModule
+}
+
+func (v *vtabTxTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabTxTable) Disconnect() error { return nil }
+
+func (v *vtabTxTable) Destroy() error { return nil }
+
+func (v *vtabTxTable) Open() (VTabCursor, error) {
+	return &vtabPlanCursor{m: &vtabPlanModule{}}, nil
+}
+
+func (v *vtabTxTable) Delete(key any) error { return nil }
+
+func (v *vtabTxTable) Insert(key any, vals []any) (int64, error) {
+	v.m.events = append(v.m.events, "insert")
+	return 1, nil
+}
+
+func (v *vtabTxTable) Update(key any, vals []any) error { return nil }
+
+func (v *vtabTxTable) PartialUpdate() bool { return false }
+
+func (v *vtabTxTable) Begin() error {
+	v.m.events = append(v.m.events, "begin")
+	return nil
+}
+
+func (v *vtabTxTable) Rename(newName string) error {
+	if newName == "forbidden" {
+		return errors.New("cannot rename to forbidden")
+	}
+	v.m.events = append(v.m.events, "rename "+newName)
+	return nil
+}
+
+func (v *vtabTxTable) Integrity(schema, table string, quick bool) ([]string, error) {
+	v.m.events = append(v.m.events, fmt.Sprintf("integrity %s.%s %v", schema, table, quick))
+	return v.m.problems, nil
+}
+
+func (v *vtabTxTable) Sync() error {
+	v.m.events = append(v.m.events, "sync")
+	return v.m.syncErr
+}
+
+func (v *vtabTxTable) Commit() error {
+	v.m.events = append(v.m.events, "commit")
+	return nil
+}
+
+func (v *vtabTxTable) Rollback() error {
+	v.m.events = append(v.m.events, "rollback")
+	return nil
+}
+
+func TestVTabModuleCapabilities(t *testing.T) {
+	m := &vtabEponymousOnlyTxModule{}
+	sql.Register("sqlite3_TestVTabModuleCapabilities", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("tx", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabModuleCapabilities", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("INSERT INTO tx VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO tx VALUES (2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"connect", "begin", "insert", "sync", "commit", "begin", "insert", "rollback"}
+	if !reflect.DeepEqual(m.events, want) {
+		t.Fatalf("expected events %v, got %v", want, m.events)
+	}
+
+	if _, err := db.Exec("CREATE VIRTUAL TABLE t USING tx"); err == nil {
+		t.Fatal("expected CREATE VIRTUAL TABLE to fail on an eponymous-only module")
+	}
+}
+
+func TestVTabEponymousModule(t *testing.T) {
+	m := &vtabEponymousModule{}
+	sql.Register("sqlite3_TestVTabEponymousModule", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("ep", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabEponymousModule", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("SELECT * FROM ep"); err != nil {
+		t.Fatalf("expected the module to be usable eponymously: %v", err)
+	}
+	if _, err := db.Exec("CREATE VIRTUAL TABLE t USING ep"); err != nil {
+		t.Fatalf("expected the module to be usable with CREATE VIRTUAL TABLE: %v", err)
+	}
+	if _, err := db.Exec("SELECT * FROM t"); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range m.events {
+		if e == "create" {
+			t.Fatalf("unexpected Create call on an eponymous module: %v", m.events)
+		}
+	}
+}
+
+// vtabSavepointModule buffers inserted rows, and restores them on
+// rollbacks to transactions or savepoints.
+type vtabSavepointModule struct {
+	data   vtabPlanModule
+	events []string
+}
+
+func (m *vtabSavepointModule) EponymousOnlyModule() {}
+
+func (m *vtabSavepointModule) TransactionModule() {}
+
+func (m *vtabSavepointModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(a INT)")
+	if err != nil {
+		return nil, err
+	}
+	return &vtabSavepointTable{m: m}, nil
+}
+
+func (m *vtabSavepointModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabSavepointModule) DestroyModule() {}
+
+type vtabSavepointTable struct {
+	m         *vtabSavepointModule
+	committed []int64
+	saved     [][]int64
+}
+
+func (v *vtabSavepointTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabSavepointTable) Disconnect() error { return nil }
+
+func (v *vtabSavepointTable) Destroy() error { return nil }
+
+func (v *vtabSavepointTable) Open() (VTabCursor, error) {
+	return &vtabPlanCursor{m: &v.m.data}, nil
+}
+
+func (v *vtabSavepointTable) Delete(key any) error { return nil }
+
+func (v *vtabSavepointTable) Insert(key any, vals []any) (int64, error) {
+	v.m.data.rows = append(v.m.data.rows, vals[0].(int64))
+	return int64(len(v.m.data.rows)), nil
+}
+
+func (v *vtabSavepointTable) Update(key any, vals []any) error { return nil }
+
+func (v *vtabSavepointTable) PartialUpdate() bool { return false }
+
+func (v *vtabSavepointTable) Begin() error {
+	v.m.events = append(v.m.events, "begin")
+	v.committed = append([]int64{}, v.m.data.rows...)
+	return nil
+}
+
+func (v *vtabSavepointTable) Commit() error {
+	v.m.events = append(v.m.events, "commit")
+	v.saved = nil
+	return nil
+}
+
+func (v *vtabSavepointTable) Rollback() error {
+	v.m.events = append(v.m.events, "rollback")
+	v.m.data.rows = v.committed
+	v.saved = nil
+	return nil
+}
+
+func (v *vtabSavepointTable) Savepoint(n int) error {
+	v.m.events = append(v.m.events, fmt.Sprintf("savepoint %d", n))
+	for len(v.saved) <= n {
+		v.saved = append(v.saved, nil)
+	}
+	v.saved = v.saved[:n+1]
+	v.saved[n] = append([]int64{}, v.m.data.rows...)
+	return nil
+}
+
+func (v *vtabSavepointTable) Release(n int) error {
+	v.m.events = append(v.m.events, fmt.Sprintf("release %d", n))
+	if n < len(v.saved) {
+		v.saved = v.saved[:n]
+	}
+	return nil
+}
+
+func (v *vtabSavepointTable) RollbackTo(n int) error {
+	v.m.events = append(v.m.events, fmt.Sprintf("rollback to %d", n))
+	if n < len(v.saved) {
+		v.m.data.rows = append([]int64{}, v.saved[n]...)
+	}
+	return nil
+}
+
+func TestVTabSavepoint(t *testing.T) {
+	m := &vtabSavepointModule{}
+	sql.Register("sqlite3_TestVTabSavepoint", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("sp", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabSavepoint", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := func() []int64 {
+		t.Helper()
+		res, err := tx.Query("SELECT a FROM sp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Close()
+		var as []int64
+		for res.Next() {
+			var a int64
+			if err := res.Scan(&a); err != nil {
+				t.Fatal(err)
+			}
+			as = append(as, a)
+		}
+		return as
+	}
+	for _, stmt := range []string{
+		"INSERT INTO sp VALUES (1)",
+		"SAVEPOINT a",
+		"INSERT INTO sp VALUES (2)",
+		"SAVEPOINT b",
+		"INSERT INTO sp VALUES (3)",
+		"ROLLBACK TO b",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if got := rows(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Fatalf("expected rows [1 2] after rolling back to b, got %v", got)
+	}
+	for _, stmt := range []string{
+		"ROLLBACK TO a",
+		"INSERT INTO sp VALUES (4)",
+		"RELEASE a",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if got := rows(); !reflect.DeepEqual(got, []int64{1, 4}) {
+		t.Fatalf("expected rows [1 4] after rolling back to a, got %v", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"begin", "savepoint 0", "savepoint 1", "rollback to 1", "rollback to 0", "release 0", "commit"}
+	if !reflect.DeepEqual(m.events, want) {
+		t.Fatalf("expected events %v, got %v", want, m.events)
+	}
+}
+
+func TestVTabSync(t *testing.T) {
+	m := &vtabEponymousOnlyTxModule{}
+	sql.Register("sqlite3_TestVTabSync", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("tx", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabSync", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE TABLE t(a INT)"); err != nil {
+		t.Fatal(err)
+	}
+	m.syncErr = errors.New("upstream rejected the writes")
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO tx VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err == nil || !strings.Contains(err.Error(), "upstream rejected the writes") {
+		t.Fatalf("expected the Sync error to fail the commit, got %v", err)
+	}
+	want := []string{"connect", "begin", "insert", "sync", "rollback"}
+	if !reflect.DeepEqual(m.events, want) {
+		t.Fatalf("expected events %v, got %v", want, m.events)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM t").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected the real table to be rolled back, got %d rows", n)
+	}
+}
+
+func TestVTabFindFunction(t *testing.T) {
+	opAbove := Op(OpFUNCTION + 1)
+	m := &vtabPlanModule{
+		schema: "CREATE TABLE x(a INT)",
+		rows:   []int64{1, 2, 3, 4},
+		bestIndex: func(csts []InfoConstraint) *IndexResult {
+			res := &IndexResult{Used: make([]bool, len(csts))}
+			for i, c := range csts {
+				res.Used[i] = c.Usable && c.Op == opAbove
+			}
+			return res
+		},
+		findFunction: func(nArg int, name string) (any, Op) {
+			switch {
+			case strings.EqualFold(name, "twice") && nArg == 1:
+				return func(a int64) int64 { return 2 * a }, 0
+			case strings.EqualFold(name, "above") && nArg == 2:
+				return func(a, b int64) bool { return a > b }, opAbove
+			}
+			return nil, 0
+		},
+	}
+	sql.Register("sqlite3_TestVTabFindFunction", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			if err := conn.OverloadFunction("twice", 1); err != nil {
+				return err
+			}
+			if err := conn.OverloadFunction("above", 2); err != nil {
+				return err
+			}
+			return conn.CreateModule("plan", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabFindFunction", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var sum int64
+	rows, err := db.Query("SELECT TWICE(a) FROM plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var x int64
+		if err := rows.Scan(&x); err != nil {
+			t.Fatal(err)
+		}
+		sum += x
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if sum != 20 {
+		t.Fatalf("expected the overloaded function to be called, got %d", sum)
+	}
+	if _, err := db.Exec("SELECT twice(1)"); err == nil {
+		t.Fatal("expected the placeholder function to fail outside of the virtual table")
+	}
+
+	m.csts, m.filters = nil, nil
+	if err := db.QueryRow("SELECT sum(a) FROM plan WHERE above(a, 2)").Scan(&sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 7 {
+		t.Fatalf("expected the overloaded predicate to filter rows, got %d", sum)
+	}
+	found := false
+	for _, csts := range m.csts {
+		for _, c := range csts {
+			if c.Op == opAbove && c.Column == 0 {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected an above constraint on column a, got %v", m.csts)
+	}
+	if len(m.filters) != 1 || !reflect.DeepEqual(m.filters[0], []any{int64(2)}) {
+		t.Fatalf("expected the above argument to be passed to Filter, got %v", m.filters)
+	}
+}
+
+func TestVTabRename(t *testing.T) {
+	m := &vtabEponymousModule{}
+	sql.Register("sqlite3_TestVTabRename", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("ep", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabRename", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE VIRTUAL TABLE t USING ep"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("ALTER TABLE t RENAME TO u"); err != nil {
+		t.Fatalf("could not rename the virtual table: %v", err)
+	}
+	if _, err := db.Exec("SELECT * FROM u"); err != nil {
+		t.Fatalf("could not select from the renamed virtual table: %v", err)
+	}
+	_, err = db.Exec("ALTER TABLE u RENAME TO forbidden")
+	if err == nil || !strings.Contains(err.Error(), "cannot rename to forbidden") {
+		t.Fatalf("expected the Rename error to abort the rename, got %v", err)
+	}
+	if _, err := db.Exec("SELECT * FROM u"); err != nil {
+		t.Fatalf("expected the virtual table to keep its name: %v", err)
+	}
+	found := false
+	for _, e := range m.events {
+		found = found || e == "rename u"
+	}
+	if !found {
+		t.Fatalf("expected Rename to be called, got %v", m.events)
+	}
+}
+
+// vtabShadowModule stores the arguments of its tables into a shadow table.
+type vtabShadowModule struct {
+	vtabTxModule
+}
+
+func (m *vtabShadowModule) ShadowNames() []string { return []string{"Config"} }
+
+func (m *vtabShadowModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	_, err := c.Exec(fmt.Sprintf("CREATE TABLE %q(k, v)", args[2]+"_config"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return m.vtabTxModule.Create(c, args)
+}
+
+func TestVTabShadowTables(t *testing.T) {
+	sql.Register("sqlite3_TestVTabShadowTables", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("shadow", &vtabShadowModule{})
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabShadowTables", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"CREATE VIRTUAL TABLE t USING shadow",
+		"CREATE TABLE t_other(a)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	types := map[string]string{}
+	rows, err := db.Query("SELECT name, type FROM pragma_table_list WHERE schema = 'main'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			t.Fatal(err)
+		}
+		types[name] = typ
+	}
+	if types["t_config"] != "shadow" {
+		t.Fatalf("expected t_config to be a shadow table, got %v", types)
+	}
+	if types["t_other"] != "table" {
+		t.Fatalf("expected t_other to be an ordinary table, got %v", types)
+	}
+}
+
+func TestVTabIntegrity(t *testing.T) {
+	if _, version, _ := Version(); version < 3044000 {
+		t.Skip("xIntegrity requires SQLite 3.44.0 or later")
+	}
+	m := &vtabEponymousModule{}
+	sql.Register("sqlite3_TestVTabIntegrity", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("ep", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabIntegrity", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE VIRTUAL TABLE t USING ep"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(pragma string) []string {
+		t.Helper()
+		rows, err := db.Query("PRAGMA " + pragma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var res []string
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, s)
+		}
+		return res
+	}
+
+	if got := check("integrity_check"); !reflect.DeepEqual(got, []string{"ok"}) {
+		t.Fatalf("expected no problems, got %v", got)
+	}
+	m.problems = []string{"cache file is stale"}
+	got := check("quick_check")
+	if len(got) != 1 || !strings.Contains(got[0], "cache file is stale") {
+		t.Fatalf("expected the problem to be reported, got %v", got)
+	}
+	if e := m.events[len(m.events)-1]; e != "integrity main.t true" {
+		t.Fatalf("unexpected Integrity call %q", e)
+	}
+}
+
+// vtabUniqueModule is a key-value table whose keys are unique.
+type vtabUniqueModule struct {
+	c         *SQLiteConn
+	keys      map[int64]bool
+	conflicts []ConflictMode
+}
+
+func (m *vtabUniqueModule) EponymousOnlyModule() {}
+
+func (m *vtabUniqueModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	if err := c.VTabConfig(VTabConstraintSupport); err != nil {
+		return nil, err
+	}
+	if err := c.VTabConfig(VTabInnocuous); err != nil {
+		return nil, err
+	}
+	if err := c.DeclareVTab("CREATE TABLE x(k INT)"); err != nil {
+		return nil, err
+	}
+	m.c = c
+	return &vtabUniqueTable{m}, nil
+}
+
+func (m *vtabUniqueModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabUniqueModule) DestroyModule() {}
+
+type vtabUniqueTable struct {
+	m *vtabUniqueModule
+}
+
+func (v *vtabUniqueTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabUniqueTable) Disconnect() error { return nil }
+
+func (v *vtabUniqueTable) Destroy() error { return nil }
+
+func (v *vtabUniqueTable) Open() (VTabCursor, error) {
+	return &vtabPlanCursor{m: &vtabPlanModule{}}, nil
+}
+
+func (v *vtabUniqueTable) Delete(key any) error { return nil }
+
+func (v *vtabUniqueTable) Insert(key any, vals []any) (int64, error) {
+	v.m.conflicts = append(v.m.conflicts, v.m.c.VTabOnConflict())
+	k := vals[0].(int64)
+	if v.m.keys[k] {
+		return 0, fmt.Errorf("duplicate key %d: %w", k, ErrConstraint)
+	}
+	v.m.keys[k] = true
+	return k, nil
+}
+
+func (v *vtabUniqueTable) Update(key any, vals []any) error { return nil }
+
+func (v *vtabUniqueTable) PartialUpdate() bool { return false }
+
+func TestVTabConstraint(t *testing.T) {
+	m := &vtabUniqueModule{keys: map[int64]bool{}}
+	sql.Register("sqlite3_TestVTabConstraint", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("uniq", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabConstraint", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("INSERT INTO uniq VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO uniq VALUES (1)")
+	var serr Error
+	if !errors.As(err, &serr) || serr.Code != ErrConstraint {
+		t.Fatalf("expected a constraint error, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "duplicate key 1") {
+		t.Fatalf("expected the error message of Insert, got %q", err)
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO uniq VALUES (1)"); err != nil {
+		t.Fatalf("expected the conflict to be ignored, got %v", err)
+	}
+	if _, err := db.Exec("INSERT OR REPLACE INTO uniq VALUES (2)"); err != nil {
+		t.Fatal(err)
+	}
+	want := []ConflictMode{ConflictAbort, ConflictAbort, ConflictIgnore, ConflictReplace}
+	if !reflect.DeepEqual(m.conflicts, want) {
+		t.Fatalf("expected conflict modes %v, got %v", want, m.conflicts)
+	}
+}
+
+// vtabRequestModule is a table of rows indexed by rowid, updated through
+// UpdateRequest.
+type vtabRequestModule struct {
+	rows     map[int64][]any
+	requests []UpdateRequest
+}
+
+func (m *vtabRequestModule) EponymousOnlyModule() {}
+
+func (m *vtabRequestModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	if err := c.DeclareVTab("CREATE TABLE x(a INT, b TEXT, c INT)"); err != nil {
+		return nil, err
+	}
+	return &vtabRequestTable{m}, nil
+}
+
+func (m *vtabRequestModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabRequestModule) DestroyModule() {}
+
+type vtabRequestTable struct {
+	m *vtabRequestModule
+}
+
+func (v *vtabRequestTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabRequestTable) Disconnect() error { return nil }
+
+func (v *vtabRequestTable) Destroy() error { return nil }
+
+func (v *vtabRequestTable) Open() (VTabCursor, error) {
+	return &vtabRequestCursor{m: v.m}, nil
+}
+
+func (v *vtabRequestTable) ApplyUpdate(req *UpdateRequest) (int64, error) {
+	v.m.requests = append(v.m.requests, *req)
+	var rowid int64
+	switch req.Kind {
+	case InsertRow:
+		rowid = int64(len(v.m.rows) + 1)
+		v.m.rows[rowid] = append([]any{}, req.Values...)
+	case UpdateRow:
+		row := v.m.rows[req.OldRowid.(int64)]
+		for i, changed := range req.Changed {
+			if changed {
+				row[i] = req.Values[i]
+			}
+		}
+		delete(v.m.rows, req.OldRowid.(int64))
+		v.m.rows[req.NewRowid.(int64)] = row
+	case DeleteRow:
+		delete(v.m.rows, req.OldRowid.(int64))
+	}
+	return rowid, nil
+}
+
+type vtabRequestCursor struct {
+	m      *vtabRequestModule
+	rowids []int64
+	index  int
+}
+
+func (vc *vtabRequestCursor) Close() error { return nil }
+
+func (vc *vtabRequestCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.rowids = vc.rowids[:0]
+	for rowid := range vc.m.rows {
+		vc.rowids = append(vc.rowids, rowid)
+	}
+	sort.Slice(vc.rowids, func(i, j int) bool { return vc.rowids[i] < vc.rowids[j] })
+	vc.index = 0
+	return nil
+}
+
+func (vc *vtabRequestCursor) Next() error {
+	vc.index++
+	return nil
+}
+
+func (vc *vtabRequestCursor) EOF() bool { return vc.index >= len(vc.rowids) }
+
+func (vc *vtabRequestCursor) Column(c *SQLiteContext, col int) error {
+	switch v := vc.m.rows[vc.rowids[vc.index]][col].(type) {
+	case int64:
+		c.ResultInt64(v)
+	case string:
+		c.ResultText(v)
+	default:
+		c.ResultNull()
+	}
+	return nil
+}
+
+func (vc *vtabRequestCursor) Rowid() (int64, error) { return vc.rowids[vc.index], nil }
+
+func TestVTabUpdateRequest(t *testing.T) {
+	m := &vtabRequestModule{rows: map[int64][]any{}}
+	sql.Register("sqlite3_TestVTabUpdateRequest", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("req", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabUpdateRequest", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"INSERT INTO req(a, b) VALUES (1, 'x')",
+		"UPDATE req SET c = NULL",
+		"UPDATE OR REPLACE req SET rowid = 5, b = 'y'",
+		"DELETE FROM req",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	want := []UpdateRequest{
+		{Kind: InsertRow, Values: []any{int64(1), "x", nil}, Changed: []bool{true, true, true}, OnConflict: ConflictAbort},
+		{Kind: UpdateRow, OldRowid: int64(1), NewRowid: int64(1), Values: []any{nil, nil, nil}, Changed: []bool{false, false, true}, OnConflict: ConflictAbort},
+		{Kind: UpdateRow, OldRowid: int64(1), NewRowid: int64(5), Values: []any{nil, "y", nil}, Changed: []bool{false, true, false}, OnConflict: ConflictReplace},
+		{Kind: DeleteRow, OldRowid: int64(5), OnConflict: ConflictAbort},
+	}
+	if !reflect.DeepEqual(m.requests, want) {
+		t.Fatalf("expected requests\n%v\ngot\n%v", want, m.requests)
+	}
+}
+
+// vtabKeyedModule is a WITHOUT ROWID table keyed by strings.
+type vtabKeyedModule struct {
+	rows   map[string]int64
+	events []string
+	// schema replaces the declared schema, if not empty
+	schema string
+}
+
+func (m *vtabKeyedModule) EponymousOnlyModule() {}
+
+func (m *vtabKeyedModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	schema := "CREATE TABLE x(id TEXT PRIMARY KEY, v INT) WITHOUT ROWID"
+	if m.schema != "" {
+		schema = m.schema
+	}
+	err := c.DeclareVTab(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &vtabKeyedTable{m}, nil
+}
+
+func (m *vtabKeyedModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabKeyedModule) DestroyModule() {}
+
+type vtabKeyedTable struct {
+	m *vtabKeyedModule
+}
+
+func (v *vtabKeyedTable) BestIndex(cst []InfoConstraint, ob []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(cst))}, nil
+}
+
+func (v *vtabKeyedTable) Disconnect() error { return nil }
+
+func (v *vtabKeyedTable) Destroy() error { return nil }
+
+func (v *vtabKeyedTable) Open() (VTabCursor, error) {
+	return &vtabKeyedCursor{m: v.m}, nil
+}
+
+func (v *vtabKeyedTable) Delete(key any) error {
+	v.m.events = append(v.m.events, fmt.Sprintf("delete %v", key))
+	delete(v.m.rows, key.(string))
+	return nil
+}
+
+func (v *vtabKeyedTable) Insert(key any, vals []any) (int64, error) {
+	v.m.events = append(v.m.events, fmt.Sprintf("insert %v %v", key, vals))
+	v.m.rows[vals[0].(string)] = vals[1].(int64)
+	return 0, nil
+}
+
+func (v *vtabKeyedTable) Update(key any, vals []any) error {
+	v.m.events = append(v.m.events, fmt.Sprintf("update %v %v", key, vals))
+	delete(v.m.rows, key.(string))
+	v.m.rows[vals[0].(string)] = vals[1].(int64)
+	return nil
+}
+
+func (v *vtabKeyedTable) PartialUpdate() bool { return false }
+
+type vtabKeyedCursor struct {
+	m    *vtabKeyedModule
+	keys []string
+}
+
+func (vc *vtabKeyedCursor) Close() error { return nil }
+
+func (vc *vtabKeyedCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.keys = vc.keys[:0]
+	for k := range vc.m.rows {
+		vc.keys = append(vc.keys, k)
+	}
+	sort.Strings(vc.keys)
+	return nil
+}
+
+func (vc *vtabKeyedCursor) Next() error {
+	vc.keys = vc.keys[1:]
+	return nil
+}
+
+func (vc *vtabKeyedCursor) EOF() bool { return len(vc.keys) == 0 }
+
+func (vc *vtabKeyedCursor) Column(c *SQLiteContext, col int) error {
+	if col == 0 {
+		c.ResultText(vc.keys[0])
+	} else {
+		c.ResultInt64(vc.m.rows[vc.keys[0]])
+	}
+	return nil
+}
+
+func TestVTabWithoutRowid(t *testing.T) {
+	m := &vtabKeyedModule{rows: map[string]int64{}}
+	sql.Register("sqlite3_TestVTabWithoutRowid", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			if err := conn.CreateModule("keyed", m); err != nil {
+				return err
+			}
+			return conn.CreateModule("composite", &vtabKeyedModule{
+				schema: "CREATE TABLE x(id TEXT, v INT, PRIMARY KEY (id, v)) without   rowid",
+			})
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabWithoutRowid", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"INSERT INTO keyed VALUES ('a', 1), ('b', 2)",
+		"UPDATE keyed SET v = 3 WHERE id = 'a'",
+		"UPDATE keyed SET id = 'c' WHERE id = 'b'",
+		"DELETE FROM keyed WHERE id = 'a'",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	want := []string{
+		"insert <nil> [a 1]",
+		"insert <nil> [b 2]",
+		"update a [a 3]",
+		"update b [c 2]",
+		"delete a",
+	}
+	if !reflect.DeepEqual(m.events, want) {
+		t.Fatalf("expected events %v, got %v", want, m.events)
+	}
+
+	var id string
+	var v int64
+	if err := db.QueryRow("SELECT id, v FROM keyed").Scan(&id, &v); err != nil {
+		t.Fatal(err)
+	}
+	if id != "c" || v != 2 {
+		t.Fatalf("unexpected row %s %d", id, v)
+	}
+	if err := db.QueryRow("SELECT rowid FROM keyed").Scan(&v); err == nil {
+		t.Fatal("expected WITHOUT ROWID table to have no rowid")
+	}
+
+	_, err = db.Exec("DELETE FROM composite")
+	if err == nil || !strings.Contains(err.Error(), "needs a single-column primary key") {
+		t.Fatalf("expected an error for a composite primary key, got %v", err)
+	}
+}
+
+// vtabDynModule declares the columns of cols, which can change while its
+// tables are connected.
+type vtabDynModule struct {
+	cols        []string
+	connects    int
+	disconnects int
+}
+
+func (m *vtabDynModule) Create(c *SQLiteConn, args []string) (VTab, error) {
+	m.connects++
+	schema := &VTabSchema{}
+	for _, col := range m.cols {
+		schema.Columns = append(schema.Columns, SchemaColumn{Name: col, Type: "INTEGER"})
+	}
+	if err := schema.Declare(c); err != nil {
+		return nil, err
+	}
+	return &vtabDynTable{m: m, n: len(m.cols)}, nil
+}
+
+func (m *vtabDynModule) Connect(c *SQLiteConn, args []string) (VTab, error) {
+	return m.Create(c, args)
+}
+
+func (m *vtabDynModule) DestroyModule() {}
+
+type vtabDynTable struct {
+	m *vtabDynModule
+	n int
+}
+
+func (v *vtabDynTable) BestIndex(csts []InfoConstraint, obs []InfoOrderBy, info IndexInformation) (*IndexResult, error) {
+	return &IndexResult{Used: make([]bool, len(csts))}, nil
+}
+
+func (v *vtabDynTable) Disconnect() error {
+	v.m.disconnects++
+	return nil
+}
+
+func (v *vtabDynTable) Destroy() error { return nil }
+
+func (v *vtabDynTable) Open() (VTabCursor, error) {
+	return &vtabDynCursor{n: v.n}, nil
+}
+
+type vtabDynCursor struct {
+	n    int
+	done bool
+}
+
+func (vc *vtabDynCursor) Close() error { return nil }
+
+func (vc *vtabDynCursor) Filter(idxNum int, idxStr string, vals []any) error {
+	vc.done = false
+	return nil
+}
+
+func (vc *vtabDynCursor) NextBatch() ([][]any, error) {
+	if vc.done {
+		return nil, nil
+	}
+	vc.done = true
+	row := make([]any, vc.n)
+	for i := range row {
+		row[i] = int64(i + 1)
+	}
+	return [][]any{row}, nil
+}
+
+func (vc *vtabDynCursor) Next() error { return nil }
+
+func (vc *vtabDynCursor) EOF() bool { return true }
+
+func (vc *vtabDynCursor) Column(c *SQLiteContext, col int) error { return nil }
+
+func (vc *vtabDynCursor) Rowid() (int64, error) { return 0, nil }
+
+func TestVTabInvalidateSchemas(t *testing.T) {
+	m := &vtabDynModule{cols: []string{"a"}}
+	sql.Register("sqlite3_TestVTabInvalidateSchemas", &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			return conn.CreateModule("dyn", m)
+		},
+	})
+	db, err := sql.Open("sqlite3_TestVTabInvalidateSchemas", ":memory:")
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE VIRTUAL TABLE t USING dyn"); err != nil {
+		t.Fatal(err)
+	}
+	columns := func() []string {
+		t.Helper()
+		rows, err := db.Query("SELECT * FROM t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		cols, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cols
+	}
+	invalidate := func() error {
+		t.Helper()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.Raw(func(driverConn any) error {
+			return driverConn.(*SQLiteConn).InvalidateVTabSchemas("dyn")
+		})
+	}
+
+	stmt, err := db.Prepare("SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	one, err := db.Prepare("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer one.Close()
+	if got := columns(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("unexpected columns %q", got)
+	}
+
+	m.cols = []string{"a", "b"}
+	if got := columns(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("expected the declared schema to be kept, got %q", got)
+	}
+	if err := invalidate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := columns(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("expected the new schema, got %q", got)
+	}
+	var a, b int64
+	if err := db.QueryRow("SELECT a, b FROM t").Scan(&a, &b); err != nil || a != 1 || b != 2 {
+		t.Fatalf("unexpected row %d %d %v", a, b, err)
+	}
+
+	// statements prepared before fail if they use the table
+	var se Error
+	if err := stmt.QueryRow().Scan(&a); !errors.As(err, &se) || se.Code != ErrSchema {
+		t.Fatalf("expected ErrSchema for a statement prepared before, got %v", err)
+	}
+	if err := one.QueryRow().Scan(&a); err != nil || a != 1 {
+		t.Fatalf("unexpected row %d %v for a statement prepared before", a, err)
+	}
+	// the old table is disconnected once no statement uses it
+	if m.connects != 2 || m.disconnects != 1 {
+		t.Fatalf("expected the table to be reconnected, got %d connects and %d disconnects", m.connects, m.disconnects)
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rows, err := conn.QueryContext(context.Background(), "SELECT * FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	err = conn.Raw(func(driverConn any) error {
+		return driverConn.(*SQLiteConn).InvalidateVTabSchemas("dyn")
+	})
+	rows.Close()
+	if err == nil || !strings.Contains(err.Error(), "while a statement is running") {
+		t.Fatalf("expected an error while a statement is running, got %v", err)
+	}
+
+	// eponymous tables are only disconnected when the connection is closed
+	err = conn.Raw(func(driverConn any) error {
+		c := driverConn.(*SQLiteConn)
+		if err := c.InvalidateVTabSchemas("unknown"); err == nil || !strings.Contains(err.Error(), "no virtual table module") {
+			t.Fatalf("expected an error for an unknown module, got %v", err)
+		}
+		return c.CreateModule("epo", &vtabCountModule{n: 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	epo, err := conn.PrepareContext(context.Background(), "SELECT count(*) FROM epo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epo.Close()
+	err = conn.Raw(func(driverConn any) error {
+		c := driverConn.(*SQLiteConn)
+		if err := c.InvalidateVTabSchemas("EPO"); err == nil || !strings.Contains(err.Error(), "eponymous virtual tables") {
+			t.Fatalf("expected an error for eponymous tables, got %v", err)
+		}
+		return c.InvalidateVTabSchemas("dyn")
+	})
+	if err != nil {
+		t.Fatalf("expected the other modules to be invalidated, got %v", err)
+	}
+	var n int
+	if err := epo.QueryRow().Scan(&n); err != nil || n != 1 {
+		t.Fatalf("unexpected count %d %v for a statement of another module", n, err)
+	}
+}
@@ -117,14 +117,15 @@ func traceCallbackTrampoline(
 	contextDB := (*C.sqlite3)(ctx)
 	connHandle := uintptr(ctx)
 
-	var traceConf TraceConfig
+	var entry traceMapEntry
 	var found bool
 	if eventCode == TraceClose {
 		// clean up traceMap: 'pop' means get and delete
-		traceConf, found = popTraceMapping(connHandle)
+		entry, found = popTraceMapping(connHandle)
 	} else {
-		traceConf, found = lookupTraceMapping(connHandle)
+		entry, found = lookupTraceMapping(connHandle)
 	}
+	traceConf := entry.config
 
 	if !found {
 		panic(fmt.Sprintf("Mapping not found for handle 0x%x (ev 0x%x)",
@@ -194,19 +195,32 @@ func traceCallbackTrampoline(
 
 	r := 0
 	if traceConf.Callback != nil {
-		r = traceConf.Callback(info)
+		r = callTraceCallback(entry.conn, traceConf.Callback, info)
 	}
 	return C.int(r)
 }
 
+// callTraceCallback calls the user callback, recovering its panics
+// since they cannot be reported to SQLite.
+func callTraceCallback(conn *SQLiteConn, callback TraceUserCallback, info TraceInfo) (r int) {
+	defer func() {
+		if p := recover(); p != nil {
+			newPanicError(conn, p)
+			r = 0
+		}
+	}()
+	return callback(info)
+}
+
 type traceMapEntry struct {
 	config TraceConfig
+	conn   *SQLiteConn
 }
 
 var traceMapLock sync.Mutex
 var traceMap = make(map[uintptr]traceMapEntry)
 
-func addTraceMapping(connHandle uintptr, traceConf TraceConfig) {
+func addTraceMapping(connHandle uintptr, traceConf TraceConfig, conn *SQLiteConn) {
 	traceMapLock.Lock()
 	defer traceMapLock.Unlock()
 
@@ -215,19 +229,19 @@ func addTraceMapping(connHandle uintptr, traceConf TraceConfig) {
 		panic(fmt.Sprintf("Adding trace config %v: handle 0x%x already registered (%v).",
 			traceConf, connHandle, oldEntryCopy.config))
 	}
-	traceMap[connHandle] = traceMapEntry{config: traceConf}
+	traceMap[connHandle] = traceMapEntry{config: traceConf, conn: conn}
 }
 
-func lookupTraceMapping(connHandle uintptr) (TraceConfig, bool) {
+func lookupTraceMapping(connHandle uintptr) (traceMapEntry, bool) {
 	traceMapLock.Lock()
 	defer traceMapLock.Unlock()
 
 	entryCopy, found := traceMap[connHandle]
-	return entryCopy.config, found
+	return entryCopy, found
 }
 
 // 'pop' = get and delete from map before returning the value to the caller
-func popTraceMapping(connHandle uintptr) (TraceConfig, bool) {
+func popTraceMapping(connHandle uintptr) (traceMapEntry, bool) {
 	traceMapLock.Lock()
 	defer traceMapLock.Unlock()
 
@@ -235,7 +249,7 @@ func popTraceMapping(connHandle uintptr) (TraceConfig, bool) {
 	if found {
 		delete(traceMap, connHandle)
 	}
-	return entryCopy.config, found
+	return entryCopy, found
 }
 
 // SetTrace installs or removes the trace callback for the given database connection.
@@ -264,7 +278,7 @@ func (c *SQLiteConn) SetTrace(requested *TraceConfig) error {
 		reqCopy.WantExpandedSQL = false
 	}
 
-	addTraceMapping(connHandle, reqCopy)
+	addTraceMapping(connHandle, reqCopy, c)
 
 	// The callback trampoline function does cleanup on Close event,
 	// regardless of the presence or absence of the user callback.